@@ -2,10 +2,14 @@ package proxyprotocol
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"io"
 	"net"
+	"net/netip"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -15,6 +19,7 @@ import (
 // Ref: https://www.haproxy.org/download/1.8/doc/proxy-protocol.txt .
 const (
 	proxyProtocolV1MaxHeaderLen = 108
+	defaultMaxHeaderBytes       = 4096
 	unknownProtocol             = 0
 	proxyProtocolV1             = 1
 	proxyProtocolV2             = 2
@@ -22,16 +27,80 @@ const (
 	v2FamlyPos                  = 13
 	v2LenPos                    = 14
 	v2AddrsPos                  = 16
+	v2IPv4AddrsLen              = 12
+	v2IPv6AddrsLen              = 36
+	v2UnixAddrsLen              = 216
+	v2UnixPathLen               = 108
+	v2TLVHeaderLen              = 3
+	v2SSLHeaderLen              = 5
+	v2Version                   = 0x20
+)
+
+// PROXY protocol commands, v1 header always use CommandProxy
+const (
+	CommandLocal byte = 0x00
+	CommandProxy byte = 0x01
+)
+
+// PROXY protocol address families, it is the high 4 bits of v2 family byte
+const (
+	AFUnspec byte = 0x00
+	AFInet   byte = 0x10
+	AFInet6  byte = 0x20
+	AFUnix   byte = 0x30
+)
+
+// PROXY protocol transport protocols, it is the low 4 bits of v2 family byte
+const (
+	TransportUnspec byte = 0x00
+	TransportStream byte = 0x01
+	TransportDgram  byte = 0x02
+)
+
+// PROXY protocol v2 TLV types
+const (
+	PP2TypeALPN          byte = 0x01
+	PP2TypeAuthority     byte = 0x02
+	PP2TypeCRC32C        byte = 0x03
+	PP2TypeNoop          byte = 0x04
+	PP2TypeUniqueID      byte = 0x05
+	PP2TypeSSL           byte = 0x20
+	PP2SubtypeSSLVersion byte = 0x21
+	PP2SubtypeSSLCN      byte = 0x22
+	PP2SubtypeSSLCipher  byte = 0x23
+	PP2SubtypeSSLSigAlg  byte = 0x24
+	PP2SubtypeSSLKeyAlg  byte = 0x25
+	PP2TypeNetNS         byte = 0x30
+)
+
+// PROXY protocol v2 PP2_TYPE_SSL client flags
+const (
+	PP2ClientSSL      byte = 0x01
+	PP2ClientCertConn byte = 0x02
+	PP2ClientCertSess byte = 0x04
 )
 
 var (
 	ErrProxyProtocolV1HeaderInvalid = errors.New("PROXY Protocol v1 header is invalid")
 	ErrProxyProtocolV2HeaderInvalid = errors.New("PROXY Protocol v2 header is invalid")
 	ErrHeaderReadTimeout            = errors.New("Header read timeout")
+	ErrHeaderTooLong                = errors.New("PROXY Protocol header is too long")
+	ErrProxyNotAllowed              = errors.New("PROXY Protocol is not allowed for this address")
+	errHeaderReadInterrupted        = errors.New("Header read interrupted")
+	proxyProtocolV1Sig              = []byte("PROXY ")
 	proxyProtocolV2Sig              = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
 
-	_ net.Conn     = &proxyProtocolConn{}
-	_ net.Listener = &proxyProtocolListener{}
+	// Buffers for reading v1 header and v2 fixed header, they are returned
+	// to pool after header is parsed.
+	headerBufferPool = sync.Pool{
+		New: func() any {
+			buf := make([]byte, proxyProtocolV1MaxHeaderLen)
+			return &buf
+		},
+	}
+
+	_ Conn     = &proxyProtocolConn{}
+	_ Listener = &proxyProtocolListener{}
 )
 
 type connErr struct {
@@ -39,25 +108,61 @@ type connErr struct {
 	err  error
 }
 
+// Listener is PROXY protocol listener, all listeners created by this package implement it
+type Listener interface {
+	net.Listener
+	// AcceptContext is like Accept but return ctx.Err() when ctx is done
+	AcceptContext(ctx context.Context) (net.Conn, error)
+}
+
+// Config is configuration of PROXY protocol listener
+type Config struct {
+	// AllowedCIDRs is protocol allowed addresses or CIDRs split by `,` if use '*' means allow any address
+	AllowedCIDRs string
+	// HeaderTimeout is timeout for PROXY protocol header read, zero means no timeout
+	HeaderTimeout time.Duration
+	// Fallback is whether use the raw connection if PROXY protocol header not present
+	Fallback bool
+	// MaxHeaderBytes is maximum length of PROXY protocol header include TLVs, zero means 4096.
+	// v1 header is always limited to 108 bytes by SPEC.
+	MaxHeaderBytes int
+	// OnReject is called when connection is not allowed to send PROXY protocol header, or
+	// header read failed. reason is ErrProxyNotAllowed, ErrHeaderReadTimeout if header not
+	// received in HeaderTimeout, ErrHeaderTooLong, or ErrProxyProtocolV1HeaderInvalid and
+	// ErrProxyProtocolV2HeaderInvalid if header is malformed or connection is closed before
+	// header complete. It is called in connection's own goroutine before Accept returns or
+	// closes the connection, so a slow hook only delays that connection.
+	OnReject func(conn net.Conn, reason error)
+}
+
 type proxyProtocolListener struct {
 	listener          net.Listener
 	allowAll          bool
 	allowedNets       []*net.IPNet
-	headerReadTimeout int // Unit is second
+	headerReadTimeout time.Duration
+	fallbackable      bool
+	maxHeaderBytes    int
+	onReject          func(conn net.Conn, reason error)
 	acceptQueue       chan *connErr
 	runningFlag       int32
+	pendingLock       sync.Mutex
+	pendingConns      map[*proxyProtocolConn]struct{}
+	acceptWaiters     int
 }
 
 func IsProxyProtocolError(err error) bool {
 	return err == ErrProxyProtocolV1HeaderInvalid ||
 		err == ErrProxyProtocolV2HeaderInvalid ||
-		err == ErrHeaderReadTimeout
+		err == ErrHeaderReadTimeout ||
+		err == ErrHeaderTooLong
 }
 
 // Create new PROXY protocol listener
 // * listener is basic listener for TCP
 // * allowedIPs is protocol allowed addresses or CIDRs split by `,` if use '*' means allow any address
-// * headerReadTimeout is timeout for PROXY protocol header read
+// * headerReadTimeout is timeout for PROXY protocol header read, unit is second, zero means no timeout
+// Returned listener implements Listener. With zero headerReadTimeout, client which sends nothing
+// keeps its goroutine until it is closed.
 func NewListener(listener net.Listener, allowedIPs string, headerReadTimeout int) (net.Listener, error) {
 	ppl, err := newListener(listener, allowedIPs, headerReadTimeout)
 	if err == nil {
@@ -66,20 +171,50 @@ func NewListener(listener net.Listener, allowedIPs string, headerReadTimeout int
 	return ppl, err
 }
 
+// Create new PROXY protocol listener which accept connections without PROXY protocol header
+// * listener is basic listener for TCP
+// * allowedIPs is protocol allowed addresses or CIDRs split by `,` if use '*' means allow any address
+// * headerReadTimeout is timeout for PROXY protocol header read, unit is second, zero means no timeout
+// * fallbackable is whether use the raw connection if PROXY protocol header not present
+// If fallbackable is true and first received bytes are not PROXY protocol header, or PROXY
+// protocol signature not complete in headerReadTimeout seconds, connection will be returned
+// with its own remote address and the received bytes can be read from it. With zero
+// headerReadTimeout, client which sends nothing keeps waiting until it sends or is closed.
+func NewListenerWithFallback(listener net.Listener, allowedIPs string, headerReadTimeout int, fallbackable bool) (Listener, error) {
+	return NewListenerWithConfig(listener, Config{
+		AllowedCIDRs:  allowedIPs,
+		HeaderTimeout: time.Duration(headerReadTimeout) * time.Second,
+		Fallback:      fallbackable,
+	})
+}
+
+// Create new PROXY protocol listener with config
+// * listener is basic listener for TCP
+// * cfg is listener configuration, see Config for details
+func NewListenerWithConfig(listener net.Listener, cfg Config) (Listener, error) {
+	ppl, err := newListenerWithConfig(listener, cfg)
+	if err != nil {
+		return nil, err
+	}
+	go ppl.acceptLoop()
+	return ppl, nil
+}
+
 func newListener(listener net.Listener, allowedIPs string, headerReadTimeout int) (*proxyProtocolListener, error) {
+	return newListenerWithConfig(listener, Config{
+		AllowedCIDRs:  allowedIPs,
+		HeaderTimeout: time.Duration(headerReadTimeout) * time.Second,
+	})
+}
+
+func newListenerWithConfig(listener net.Listener, cfg Config) (*proxyProtocolListener, error) {
 	allowAll := false
 	allowedNets := []*net.IPNet{}
-	if allowedIPs == "*" {
+	if cfg.AllowedCIDRs == "*" {
 		allowAll = true
 	} else {
-		for _, aip := range strings.Split(allowedIPs, ",") {
-			saip := strings.TrimSpace(aip)
-			_, ipnet, err := net.ParseCIDR(saip)
-			if err == nil {
-				allowedNets = append(allowedNets, ipnet)
-				continue
-			}
-			_, ipnet, err = net.ParseCIDR(saip + "/32")
+		for _, aip := range strings.Split(cfg.AllowedCIDRs, ",") {
+			ipnet, err := parseAllowedNet(strings.TrimSpace(aip))
 			if err != nil {
 				return nil, err
 			}
@@ -90,12 +225,33 @@ func newListener(listener net.Listener, allowedIPs string, headerReadTimeout int
 		listener:          listener,
 		allowAll:          allowAll,
 		allowedNets:       allowedNets,
-		headerReadTimeout: headerReadTimeout,
+		headerReadTimeout: cfg.HeaderTimeout,
+		fallbackable:      cfg.Fallback,
+		maxHeaderBytes:    cfg.MaxHeaderBytes,
+		onReject:          cfg.OnReject,
 		acceptQueue:       make(chan *connErr, 1),
 		runningFlag:       1,
+		pendingConns:      make(map[*proxyProtocolConn]struct{}),
 	}, nil
 }
 
+// Parse CIDR or single address as network, both IPv4 and IPv6 are supported.
+// IPv4-mapped IPv6 address is treated as IPv4 address.
+func parseAllowedNet(saip string) (*net.IPNet, error) {
+	_, ipnet, err := net.ParseCIDR(saip)
+	if err == nil {
+		return ipnet, nil
+	}
+	ip := net.ParseIP(saip)
+	if ip == nil {
+		return nil, &net.ParseError{Type: "CIDR address", Text: saip}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
 // Check remote address is allowed
 func (l *proxyProtocolListener) checkAllowed(raddr net.Addr) bool {
 	if l.allowAll {
@@ -116,18 +272,70 @@ func (l *proxyProtocolListener) checkAllowed(raddr net.Addr) bool {
 
 // Create proxyProtocolConn instance
 func (l *proxyProtocolListener) createProxyProtocolConn(conn net.Conn) (*proxyProtocolConn, error) {
-	ppconn := &proxyProtocolConn{
+	return l.initProxyProtocolConn(l.newProxyProtocolConn(conn))
+}
+
+func (l *proxyProtocolListener) newProxyProtocolConn(conn net.Conn) *proxyProtocolConn {
+	return &proxyProtocolConn{
 		Conn:              conn,
 		headerReadTimeout: l.headerReadTimeout,
+		fallbackable:      l.fallbackable,
+		maxHeaderBytes:    l.maxHeaderBytes,
 	}
-	err := ppconn.readClientAddrBehindProxy(conn.RemoteAddr())
+}
+
+// Read PROXY protocol header, close connection if failed
+func (l *proxyProtocolListener) initProxyProtocolConn(ppconn *proxyProtocolConn) (*proxyProtocolConn, error) {
+	err := ppconn.readClientAddrBehindProxy(ppconn.Conn.RemoteAddr())
 	if err != nil {
+		if err != errHeaderReadInterrupted {
+			l.reject(ppconn.Conn, err)
+		}
 		ppconn.Close()
 		return nil, err
 	}
 	return ppconn, nil
 }
 
+// Call OnReject hook if it is set
+func (l *proxyProtocolListener) reject(conn net.Conn, reason error) {
+	if l.onReject != nil {
+		l.onReject(conn, reason)
+	}
+}
+
+func (l *proxyProtocolListener) addPendingConn(ppconn *proxyProtocolConn) {
+	l.pendingLock.Lock()
+	l.pendingConns[ppconn] = struct{}{}
+	l.pendingLock.Unlock()
+}
+
+func (l *proxyProtocolListener) removePendingConn(ppconn *proxyProtocolConn) {
+	l.pendingLock.Lock()
+	delete(l.pendingConns, ppconn)
+	l.pendingLock.Unlock()
+}
+
+func (l *proxyProtocolListener) enterAccept() {
+	l.pendingLock.Lock()
+	l.acceptWaiters++
+	l.pendingLock.Unlock()
+}
+
+// Leave Accept, if it is canceled and no other Accept is waiting, interrupt
+// all connections which are still reading PROXY protocol header
+func (l *proxyProtocolListener) leaveAccept(canceled bool) {
+	l.pendingLock.Lock()
+	defer l.pendingLock.Unlock()
+	l.acceptWaiters--
+	if !canceled || l.acceptWaiters > 0 {
+		return
+	}
+	for ppconn := range l.pendingConns {
+		ppconn.interrupt()
+	}
+}
+
 func (l *proxyProtocolListener) running() bool {
 	r := atomic.LoadInt32(&l.runningFlag)
 	return r == 1
@@ -140,18 +348,42 @@ func (l *proxyProtocolListener) acceptLoop() {
 			l.acceptQueue <- &connErr{conn, err}
 		} else if !l.checkAllowed(conn.RemoteAddr()) && l.running() {
 			// do not parse proxy protocol header
-			l.acceptQueue <- &connErr{conn, nil}
+			go l.passConn(conn)
 		} else {
-			go l.wrapConn(conn)
+			// Register before start goroutine, so AcceptContext can interrupt
+			// header read even it is not started.
+			ppconn := l.newProxyProtocolConn(conn)
+			l.addPendingConn(ppconn)
+			go l.wrapConn(ppconn)
 		}
 	}
 }
 
-func (l *proxyProtocolListener) wrapConn(conn net.Conn) {
-	wconn, err := l.createProxyProtocolConn(conn)
+// Pass not allowed connection to Accept, OnReject hook is called here
+// to avoid blocking accept loop.
+func (l *proxyProtocolListener) passConn(conn net.Conn) {
+	l.reject(conn, ErrProxyNotAllowed)
 	if l.running() {
-		l.acceptQueue <- &connErr{wconn, err}
+		l.acceptQueue <- &connErr{conn, nil}
 	} else {
+		conn.Close()
+	}
+}
+
+func (l *proxyProtocolListener) wrapConn(ppconn *proxyProtocolConn) {
+	wconn, err := l.initProxyProtocolConn(ppconn)
+	l.removePendingConn(ppconn)
+	if err == errHeaderReadInterrupted {
+		// header read is interrupted by AcceptContext, just drop it
+		return
+	}
+	if err == nil && ppconn.interrupted() {
+		// header is received before interrupted, keep it for next Accept
+		wconn.SetReadDeadline(time.Time{})
+	}
+	if l.running() {
+		l.acceptQueue <- &connErr{wconn, err}
+	} else if wconn != nil {
 		wconn.Close()
 	}
 }
@@ -161,14 +393,37 @@ func (l *proxyProtocolListener) wrapConn(conn net.Conn) {
 // As PROXY protocol SPEC wrote, if invalid PROXY protocol header
 // received, or valid header received but connection's address not
 // allowed, Accept function will return an error and close this connection.
+// ErrHeaderReadTimeout is returned only if header not received in timeout. If client
+// closes connection before header complete, such as health check which connects and
+// closes, ErrProxyProtocolV1HeaderInvalid or ErrProxyProtocolV2HeaderInvalid is returned,
+// older versions returned ErrHeaderReadTimeout in this case.
 func (l *proxyProtocolListener) Accept() (net.Conn, error) {
-	ce := <-l.acceptQueue
-	if opErr, ok := ce.err.(*net.OpError); ok {
-		if opErr.Err.Error() == "use of closed network connection" {
-			close(l.acceptQueue)
+	return l.AcceptContext(context.Background())
+}
+
+// Accept new connection with context
+// When ctx is done, ctx.Err() will be returned. If no other Accept call is waiting,
+// all connections which are still reading PROXY protocol header will be interrupted
+// and closed without calling OnReject. Connections whose header is already received
+// are kept for next Accept.
+func (l *proxyProtocolListener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	l.enterAccept()
+	select {
+	case ce, ok := <-l.acceptQueue:
+		l.leaveAccept(false)
+		if !ok {
+			return nil, net.ErrClosed
+		}
+		if opErr, ok := ce.err.(*net.OpError); ok {
+			if opErr.Err.Error() == "use of closed network connection" {
+				close(l.acceptQueue)
+			}
 		}
+		return ce.conn, ce.err
+	case <-ctx.Done():
+		l.leaveAccept(true)
+		return nil, ctx.Err()
 	}
-	return ce.conn, ce.err
 }
 
 // Close listener
@@ -183,119 +438,446 @@ func (l *proxyProtocolListener) Addr() net.Addr {
 	return l.listener.Addr()
 }
 
+// SSLInfo is the decoded PP2_TYPE_SSL TLV of PROXY protocol v2 header
+type SSLInfo struct {
+	// Client is bit field of PP2ClientSSL, PP2ClientCertConn and PP2ClientCertSess
+	Client byte
+	// Verify is zero if client presented a certificate and it was successfully verified
+	Verify uint32
+	// TLVs is sub TLVs of SSL TLV, such as PP2SubtypeSSLVersion and PP2SubtypeSSLCN
+	TLVs map[byte][]byte
+}
+
+// Get SSL version used by client, such as "TLSv1.2"
+func (s *SSLInfo) Version() string {
+	return string(s.TLVs[PP2SubtypeSSLVersion])
+}
+
+// Get Common Name of client certificate
+func (s *SSLInfo) CommonName() string {
+	return string(s.TLVs[PP2SubtypeSSLCN])
+}
+
+// Check client presented a certificate and it was successfully verified
+func (s *SSLInfo) Verified() bool {
+	return s.Client&PP2ClientSSL != 0 && s.Verify == 0
+}
+
+// Header is the decoded PROXY protocol header
+type Header struct {
+	// Version is 1 or 2
+	Version int
+	// Command is CommandLocal or CommandProxy
+	Command byte
+	// Family is one of AFUnspec, AFInet, AFInet6 and AFUnix
+	Family byte
+	// Transport is one of TransportUnspec, TransportStream and TransportDgram
+	Transport byte
+	// SourceAddr is client address, nil if header not contains it
+	SourceAddr net.Addr
+	// DestinationAddr is the address client connected to, nil if header not contains it
+	DestinationAddr net.Addr
+	// TLVs is TLVs of v2 header, key is TLV type
+	TLVs map[byte][]byte
+}
+
+// Conn is connection returned by Listener's Accept whose PROXY protocol header is read.
+// Connections not allowed to send PROXY protocol header are returned as is and do not
+// implement it.
+type Conn interface {
+	net.Conn
+	// Header return decoded PROXY protocol header, nil if fallback to raw connection
+	Header() *Header
+	// TLVs return all TLVs in PROXY protocol v2 header, key is TLV type
+	TLVs() map[byte][]byte
+	// Authority return PP2_TYPE_AUTHORITY TLV
+	Authority() string
+	// ALPN return PP2_TYPE_ALPN TLV
+	ALPN() []byte
+	// SSL return decoded PP2_TYPE_SSL TLV, nil if not present
+	SSL() *SSLInfo
+}
+
 type proxyProtocolConn struct {
 	net.Conn
-	headerReadTimeout  int
+	headerReadTimeout  time.Duration
+	fallbackable       bool
+	maxHeaderBytes     int
+	interruptFlag      int32
 	clientIP           net.Addr
+	serverIP           net.Addr
+	header             *Header
+	headerBuffer       *[]byte
+	ssl                *SSLInfo
 	exceedBuffer       []byte
 	exceedBufferStart  int
 	exceedBufferLen    int
 	exceedBufferReaded bool
 }
 
+// Interrupt PROXY protocol header read
+func (c *proxyProtocolConn) interrupt() {
+	atomic.StoreInt32(&c.interruptFlag, 1)
+	c.Conn.SetReadDeadline(time.Now())
+}
+
+func (c *proxyProtocolConn) interrupted() bool {
+	return atomic.LoadInt32(&c.interruptFlag) == 1
+}
+
 func (c *proxyProtocolConn) readClientAddrBehindProxy(connRemoteAddr net.Addr) error {
 	return c.parseHeader(connRemoteAddr)
 }
 
 func (c *proxyProtocolConn) parseHeader(connRemoteAddr net.Addr) error {
 	ver, buffer, err := c.readHeader()
+	defer c.releaseHeaderBuffer()
 	if err != nil {
 		return err
 	}
+	var header *Header
 	switch ver {
 	case proxyProtocolV1:
-		raddr, v1err := c.extractClientIPV1(buffer, connRemoteAddr)
-		if v1err != nil {
-			return v1err
-		}
-		c.clientIP = raddr
-		return nil
+		header, err = c.extractHeaderV1(buffer)
 	case proxyProtocolV2:
-		raddr, v2err := c.extraceClientIPV2(buffer, connRemoteAddr)
-		if v2err != nil {
-			return v2err
-		}
-		c.clientIP = raddr
+		header, err = c.extractHeaderV2(buffer)
+	case unknownProtocol:
+		// fallback to raw connection
+		c.clientIP = connRemoteAddr
 		return nil
 	default:
 		panic("Should not come here")
 	}
+	if err != nil {
+		return err
+	}
+	c.header = header
+	c.clientIP = header.SourceAddr
+	if c.clientIP == nil {
+		// keep local connection address if header not contains it
+		c.clientIP = connRemoteAddr
+	}
+	c.serverIP = header.DestinationAddr
+	return nil
 }
 
-func (c *proxyProtocolConn) extractClientIPV1(buffer []byte, connRemoteAddr net.Addr) (net.Addr, error) {
-	header := string(buffer)
-	parts := strings.Split(header, " ")
-	if len(parts) != 6 {
-		if len(parts) > 1 && parts[1] == "UNKNOWN\r\n" {
-			return connRemoteAddr, nil
-		}
-		return nil, ErrProxyProtocolV1HeaderInvalid
-	}
-	clientIPStr := parts[2]
-	clientPortStr := parts[4]
-	iptype := parts[1]
-	ip := net.ParseIP(clientIPStr)
-	if ip == nil {
+// Header fields are split by single space, and must end with CRLF
+func (c *proxyProtocolConn) extractHeaderV1(buffer []byte) (*Header, error) {
+	line := string(buffer)
+	if !strings.HasSuffix(line, "\r\n") {
 		return nil, ErrProxyProtocolV1HeaderInvalid
 	}
-	port, err := strconv.Atoi(clientPortStr)
-	if err != nil {
+	// One more field to check there are too many fields
+	var parts [7]string
+	nparts := splitFieldsV1(line[0:len(line)-2], parts[:])
+	if nparts < 2 || parts[0] != "PROXY" {
 		return nil, ErrProxyProtocolV1HeaderInvalid
 	}
-	if port <= 0 || port > 65535 {
-		return nil, ErrProxyProtocolV1HeaderInvalid
+	header := &Header{
+		Version: proxyProtocolV1,
+		Command: CommandProxy,
 	}
-	switch iptype {
-	case "TCP4", "TCP6":
-		return &net.TCPAddr{
-			IP:   ip,
-			Port: port,
-		}, nil
+	switch parts[1] {
+	case "TCP4":
+		header.Family = AFInet
+	case "TCP6":
+		header.Family = AFInet6
 	case "UNKNOWN":
-		return connRemoteAddr, nil
+		// receiver must ignore anything after UNKNOWN
+		return header, nil
 	default:
 		return nil, ErrProxyProtocolV1HeaderInvalid
 	}
+	if nparts != 6 {
+		return nil, ErrProxyProtocolV1HeaderInvalid
+	}
+	srcIP, err := parseIPV1(header.Family, parts[2])
+	if err != nil {
+		return nil, err
+	}
+	dstIP, err := parseIPV1(header.Family, parts[3])
+	if err != nil {
+		return nil, err
+	}
+	srcPort, err := parsePortV1(parts[4])
+	if err != nil {
+		return nil, err
+	}
+	dstPort, err := parsePortV1(parts[5])
+	if err != nil {
+		return nil, err
+	}
+	header.Transport = TransportStream
+	if header.Family == AFInet {
+		src4, dst4 := srcIP.As4(), dstIP.As4()
+		header.SourceAddr, header.DestinationAddr = newAddrPair(TransportStream, src4[:], dst4[:], srcPort, dstPort)
+	} else {
+		src16, dst16 := srcIP.As16(), dstIP.As16()
+		header.SourceAddr, header.DestinationAddr = newAddrPair(TransportStream, src16[:], dst16[:], srcPort, dstPort)
+	}
+	return header, nil
 }
 
-func (c *proxyProtocolConn) extraceClientIPV2(buffer []byte, connRemoteAddr net.Addr) (net.Addr, error) {
+// Split line by single space into fields without allocation, return number
+// of fields. If line has more fields than len(fields), return len(fields).
+func splitFieldsV1(line string, fields []string) int {
+	n := 0
+	for n < len(fields) {
+		pos := strings.IndexByte(line, ' ')
+		if pos == -1 {
+			fields[n] = line
+			return n + 1
+		}
+		fields[n] = line[0:pos]
+		line = line[pos+1:]
+		n++
+	}
+	return n
+}
+
+// IP should match the family
+func parseIPV1(famly byte, ipStr string) (netip.Addr, error) {
+	ip, err := netip.ParseAddr(ipStr)
+	if err != nil || ip.Zone() != "" {
+		return netip.Addr{}, ErrProxyProtocolV1HeaderInvalid
+	}
+	isV6 := strings.IndexByte(ipStr, ':') != -1
+	if isV6 != (famly == AFInet6) {
+		return netip.Addr{}, ErrProxyProtocolV1HeaderInvalid
+	}
+	return ip, nil
+}
+
+// Port should be 1 to 5 digits in range 0 to 65535
+func parsePortV1(portStr string) (uint16, error) {
+	if len(portStr) == 0 || len(portStr) > 5 {
+		return 0, ErrProxyProtocolV1HeaderInvalid
+	}
+	// strconv.Atoi accepts sign, so check digits first
+	for i := 0; i < len(portStr); i++ {
+		if portStr[i] < '0' || portStr[i] > '9' {
+			return 0, ErrProxyProtocolV1HeaderInvalid
+		}
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port > 65535 {
+		return 0, ErrProxyProtocolV1HeaderInvalid
+	}
+	return uint16(port), nil
+}
+
+func (c *proxyProtocolConn) extractHeaderV2(buffer []byte) (*Header, error) {
 	verCmd := buffer[v2CmdPos]
 	famly := buffer[v2FamlyPos]
-	switch verCmd & 0x0F {
-	case 0x01: /* PROXY command */
-		switch famly {
-		case 0x11: /* TCPv4 */
+	header := &Header{
+		Version: proxyProtocolV2,
+		Command: verCmd & 0x0F,
+	}
+	switch header.Command {
+	case CommandProxy:
+		header.Family = famly & 0xF0
+		header.Transport = famly & 0x0F
+		if famly == AFUnspec|TransportUnspec {
+			// unspecified protocol, keep local connection address
+			return header, nil
+		}
+		transport := header.Transport
+		if transport != TransportStream && transport != TransportDgram {
+			return nil, ErrProxyProtocolV2HeaderInvalid
+		}
+		switch header.Family {
+		case AFInet: /* TCPv4 or UDPv4 */
+			if len(buffer) < v2AddrsPos+v2IPv4AddrsLen {
+				return nil, ErrProxyProtocolV2HeaderInvalid
+			}
+			if err := c.extractTLVsV2(header, buffer[v2AddrsPos+v2IPv4AddrsLen:]); err != nil {
+				return nil, err
+			}
 			srcAddrV4 := net.IP(buffer[v2AddrsPos : v2AddrsPos+4])
+			dstAddrV4 := net.IP(buffer[v2AddrsPos+4 : v2AddrsPos+8])
 			srcPortV4 := binary.BigEndian.Uint16(buffer[v2AddrsPos+8 : v2AddrsPos+10])
-			return &net.TCPAddr{
-				IP:   srcAddrV4,
-				Port: int(srcPortV4),
-			}, nil
-		case 0x21: /* TCPv6 */
+			dstPortV4 := binary.BigEndian.Uint16(buffer[v2AddrsPos+10 : v2AddrsPos+12])
+			header.SourceAddr, header.DestinationAddr = newAddrPair(transport, srcAddrV4, dstAddrV4, srcPortV4, dstPortV4)
+		case AFInet6: /* TCPv6 or UDPv6 */
+			if len(buffer) < v2AddrsPos+v2IPv6AddrsLen {
+				return nil, ErrProxyProtocolV2HeaderInvalid
+			}
+			if err := c.extractTLVsV2(header, buffer[v2AddrsPos+v2IPv6AddrsLen:]); err != nil {
+				return nil, err
+			}
 			srcAddrV6 := net.IP(buffer[v2AddrsPos : v2AddrsPos+16])
+			dstAddrV6 := net.IP(buffer[v2AddrsPos+16 : v2AddrsPos+32])
 			srcPortV6 := binary.BigEndian.Uint16(buffer[v2AddrsPos+32 : v2AddrsPos+34])
-			return &net.TCPAddr{
-				IP:   srcAddrV6,
-				Port: int(srcPortV6),
-			}, nil
+			dstPortV6 := binary.BigEndian.Uint16(buffer[v2AddrsPos+34 : v2AddrsPos+36])
+			header.SourceAddr, header.DestinationAddr = newAddrPair(transport, srcAddrV6, dstAddrV6, srcPortV6, dstPortV6)
+		case AFUnix: /* UNIX stream or UNIX datagram */
+			if len(buffer) < v2AddrsPos+v2UnixAddrsLen {
+				return nil, ErrProxyProtocolV2HeaderInvalid
+			}
+			if err := c.extractTLVsV2(header, buffer[v2AddrsPos+v2UnixAddrsLen:]); err != nil {
+				return nil, err
+			}
+			// unnamed socket, keep local connection address
+			if srcPath := unixPathV2(buffer[v2AddrsPos : v2AddrsPos+v2UnixPathLen]); srcPath != "" {
+				header.SourceAddr = newUnixAddrV2(transport, srcPath)
+			}
+			if dstPath := unixPathV2(buffer[v2AddrsPos+v2UnixPathLen : v2AddrsPos+v2UnixAddrsLen]); dstPath != "" {
+				header.DestinationAddr = newUnixAddrV2(transport, dstPath)
+			}
 		default:
 			// unsupported protocol, keep local connection address
-			return connRemoteAddr, nil
 		}
-	case 0x00: /* LOCAL command */
+		return header, nil
+	case CommandLocal:
 		// keep local connection address for LOCAL
-		return connRemoteAddr, nil
+		return header, nil
 	default:
 		// not a supported command
 		return nil, ErrProxyProtocolV2HeaderInvalid
 	}
 }
 
+// Create UDP addresses for DGRAM transport otherwise create TCP addresses.
+// IPs are copied because header buffer will be reused, and addresses are
+// allocated together to reduce allocations.
+func newAddrPair(transport byte, srcIP, dstIP []byte, srcPort, dstPort uint16) (net.Addr, net.Addr) {
+	ips := make(net.IP, len(srcIP)+len(dstIP))
+	copy(ips, srcIP)
+	copy(ips[len(srcIP):], dstIP)
+	src, dst := ips[0:len(srcIP):len(srcIP)], ips[len(srcIP):]
+	if transport == TransportDgram {
+		addrs := new([2]net.UDPAddr)
+		addrs[0] = net.UDPAddr{IP: src, Port: int(srcPort)}
+		addrs[1] = net.UDPAddr{IP: dst, Port: int(dstPort)}
+		return &addrs[0], &addrs[1]
+	}
+	addrs := new([2]net.TCPAddr)
+	addrs[0] = net.TCPAddr{IP: src, Port: int(srcPort)}
+	addrs[1] = net.TCPAddr{IP: dst, Port: int(dstPort)}
+	return &addrs[0], &addrs[1]
+}
+
+// Create UNIX address with "unixgram" network for DGRAM transport
+func newUnixAddrV2(transport byte, path string) net.Addr {
+	network := "unix"
+	if transport == TransportDgram {
+		network = "unixgram"
+	}
+	return &net.UnixAddr{
+		Name: path,
+		Net:  network,
+	}
+}
+
+// UNIX path is padded with NUL bytes, trim from the first NUL byte
+func unixPathV2(buffer []byte) string {
+	if pos := bytes.IndexByte(buffer, 0); pos != -1 {
+		buffer = buffer[:pos]
+	}
+	return string(buffer)
+}
+
+// Parse TLVs after address block and PP2_TYPE_SSL TLV if present
+func (c *proxyProtocolConn) extractTLVsV2(header *Header, buffer []byte) error {
+	if len(buffer) == 0 {
+		return nil
+	}
+	// TLV values reference the copy because header buffer will be reused
+	buffer = append([]byte(nil), buffer...)
+	tlvs, err := parseTLVsV2(buffer)
+	if err != nil {
+		return err
+	}
+	if sslBuf, have := tlvs[PP2TypeSSL]; have {
+		ssl, err := parseSSLTLVV2(sslBuf)
+		if err != nil {
+			return err
+		}
+		c.ssl = ssl
+	}
+	header.TLVs = tlvs
+	return nil
+}
+
+func parseTLVsV2(buffer []byte) (map[byte][]byte, error) {
+	if len(buffer) == 0 {
+		return nil, nil
+	}
+	tlvs := make(map[byte][]byte)
+	for len(buffer) > 0 {
+		if len(buffer) < v2TLVHeaderLen {
+			return nil, ErrProxyProtocolV2HeaderInvalid
+		}
+		endPos := v2TLVHeaderLen + int(binary.BigEndian.Uint16(buffer[1:3]))
+		if len(buffer) < endPos {
+			return nil, ErrProxyProtocolV2HeaderInvalid
+		}
+		tlvs[buffer[0]] = buffer[v2TLVHeaderLen:endPos]
+		buffer = buffer[endPos:]
+	}
+	return tlvs, nil
+}
+
+func parseSSLTLVV2(buffer []byte) (*SSLInfo, error) {
+	if len(buffer) < v2SSLHeaderLen {
+		return nil, ErrProxyProtocolV2HeaderInvalid
+	}
+	tlvs, err := parseTLVsV2(buffer[v2SSLHeaderLen:])
+	if err != nil {
+		return nil, err
+	}
+	return &SSLInfo{
+		Client: buffer[0],
+		Verify: binary.BigEndian.Uint32(buffer[1:5]),
+		TLVs:   tlvs,
+	}, nil
+}
+
 // Get client address
 func (c *proxyProtocolConn) RemoteAddr() net.Addr {
 	return c.clientIP
 }
 
+// Get address client connected to, it is the destination address in PROXY
+// protocol header. If header not contains it, such as v1 UNKNOWN and v2 LOCAL
+// command, return local address of the connection.
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	if c.serverIP != nil {
+		return c.serverIP
+	}
+	return c.Conn.LocalAddr()
+}
+
+// Get all TLVs in PROXY protocol v2 header, key is TLV type.
+// Return nil if no TLV received.
+func (c *proxyProtocolConn) TLVs() map[byte][]byte {
+	if c.header == nil {
+		return nil
+	}
+	return c.header.TLVs
+}
+
+// Get PP2_TYPE_AUTHORITY TLV, normally it is the SNI sent by client
+func (c *proxyProtocolConn) Authority() string {
+	return string(c.TLVs()[PP2TypeAuthority])
+}
+
+// Get PP2_TYPE_ALPN TLV, it is the application protocol negotiated with client
+func (c *proxyProtocolConn) ALPN() []byte {
+	return c.TLVs()[PP2TypeALPN]
+}
+
+// Get decoded PROXY protocol header, return nil if connection fallback to
+// raw connection without header.
+func (c *proxyProtocolConn) Header() *Header {
+	return c.header
+}
+
+// Get decoded PP2_TYPE_SSL TLV, return nil if not present
+func (c *proxyProtocolConn) SSL() *SSLInfo {
+	return c.ssl
+}
+
 // Read received data
 func (c *proxyProtocolConn) Read(buffer []byte) (int, error) {
 	if c.exceedBufferReaded {
@@ -306,68 +888,187 @@ func (c *proxyProtocolConn) Read(buffer []byte) (int, error) {
 		return c.Conn.Read(buffer)
 	}
 
-	buflen := len(buffer)
-	nExceedRead := c.exceedBufferLen - c.exceedBufferStart
-	// buffer length is less or equals than exceedBuffer length
-	if nExceedRead >= buflen {
-		copy(buffer[0:], c.exceedBuffer[c.exceedBufferStart:c.exceedBufferStart+buflen])
-		c.exceedBufferStart += buflen
-		return buflen, nil
-	}
-	// buffer length is great than exceedBuffer length
-	copy(buffer[0:nExceedRead], c.exceedBuffer[c.exceedBufferStart:])
-	n, err := c.Conn.Read(buffer[nExceedRead-1:])
-	if err == nil {
-		// If read is success set buffer start to buffer length
-		// If fail make rest buffer can be read in next time
-		c.exceedBufferStart = c.exceedBufferLen
-		return n + nExceedRead - 1, nil
-	}
-	return 0, err
+	// Only return exceedBuffer data, read from connection may block if
+	// client is waiting for response, so leave it to next time.
+	n := copy(buffer, c.exceedBuffer[c.exceedBufferStart:c.exceedBufferLen])
+	c.exceedBufferStart += n
+	return n, nil
 }
 
+// Returned buffer may be from headerBufferPool, call releaseHeaderBuffer
+// when it is not used.
 func (c *proxyProtocolConn) readHeader() (int, []byte, error) {
-	buf := make([]byte, proxyProtocolV1MaxHeaderLen)
-	// This mean all header data should be read in headerReadTimeout seconds.
-	c.Conn.SetReadDeadline(time.Now().Add(time.Duration(c.headerReadTimeout) * time.Second))
-	// When function return clean read deadline.
-	defer func() {
-		c.Conn.SetReadDeadline(time.Time{})
-	}()
-	n, err := c.Conn.Read(buf)
+	c.headerBuffer = headerBufferPool.Get().(*[]byte)
+	buf := *c.headerBuffer
+	if c.headerReadTimeout > 0 {
+		// This mean all header data should be read in headerReadTimeout.
+		c.Conn.SetReadDeadline(time.Now().Add(c.headerReadTimeout))
+		// When function return clean read deadline.
+		defer func() {
+			c.Conn.SetReadDeadline(time.Time{})
+		}()
+	}
+	// Deadline may be overwritten if interrupted before it is set
+	if c.interrupted() {
+		return unknownProtocol, nil, errHeaderReadInterrupted
+	}
+	// Connection closed before sending anything is treated as invalid v1 header,
+	// as same as other data which is not PROXY protocol.
+	n, err := c.readMoreHeader(buf, ErrProxyProtocolV1HeaderInvalid)
 	if err != nil {
-		return unknownProtocol, nil, ErrHeaderReadTimeout
+		if err == ErrHeaderReadTimeout && c.fallbackable {
+			// client not send anything, maybe it is waiting for server
+			return unknownProtocol, nil, nil
+		}
+		return unknownProtocol, nil, err
+	}
+	if hasSigPrefix(buf[0:n], proxyProtocolV2Sig) {
+		return c.readHeaderV2(buf, n)
+	}
+	return c.readHeaderV1(buf, n)
+}
+
+// Read v1 header until CRLF, buf contains n bytes already read
+func (c *proxyProtocolConn) readHeaderV1(buf []byte, n int) (int, []byte, error) {
+	maxLen := c.maxHeaderLen()
+	if maxLen > len(buf) {
+		maxLen = len(buf)
 	}
-	if n >= 16 {
-		if bytes.Equal(buf[0:12], proxyProtocolV2Sig) && (buf[v2CmdPos]&0xF0) == 0x20 {
-			endPos := 16 + int(binary.BigEndian.Uint16(buf[v2LenPos:v2LenPos+2]))
-			if n < endPos {
-				return unknownProtocol, nil, ErrProxyProtocolV2HeaderInvalid
+	for {
+		if !hasSigPrefix(buf[0:n], proxyProtocolV1Sig) {
+			return c.notProxyProtocol(buf[0:n], ErrProxyProtocolV1HeaderInvalid)
+		}
+		pos := bytes.IndexByte(buf[0:n], byte(10))
+		if pos != -1 {
+			if pos == 0 || buf[pos-1] != byte(13) {
+				return unknownProtocol, nil, ErrProxyProtocolV1HeaderInvalid
+			}
+			endPos := pos + 1
+			if endPos > maxLen {
+				return unknownProtocol, nil, ErrHeaderTooLong
 			}
 			if n > endPos {
-				c.exceedBuffer = buf[endPos:]
-				c.exceedBufferLen = n - endPos + 1
+				c.setExceedBuffer(buf[endPos:n])
 			}
-			return proxyProtocolV2, buf[0:endPos], nil
+			return proxyProtocolV1, buf[0:endPos], nil
 		}
+		if n >= maxLen {
+			return unknownProtocol, nil, ErrHeaderTooLong
+		}
+		nr, err := c.readMoreHeader(buf[n:], ErrProxyProtocolV1HeaderInvalid)
+		if err == ErrHeaderReadTimeout {
+			// client stop sending before signature complete, maybe it is waiting for server
+			return c.notProxyProtocol(buf[0:n], err)
+		}
+		if err != nil {
+			return unknownProtocol, nil, err
+		}
+		n += nr
 	}
-	if n >= 5 {
-		if string(buf[0:5]) != "PROXY" {
-			return unknownProtocol, nil, ErrProxyProtocolV1HeaderInvalid
+}
+
+// Read v2 header with length in it, buf contains n bytes already read
+func (c *proxyProtocolConn) readHeaderV2(buf []byte, n int) (int, []byte, error) {
+	for {
+		if !hasSigPrefix(buf[0:n], proxyProtocolV2Sig) {
+			return c.notProxyProtocol(buf[0:n], ErrProxyProtocolV2HeaderInvalid)
 		}
-		pos := bytes.IndexByte(buf, byte(10))
-		if pos == -1 {
-			return unknownProtocol, nil, ErrProxyProtocolV1HeaderInvalid
+		if n >= v2AddrsPos {
+			break
 		}
-		if buf[pos-1] != byte(13) {
-			return unknownProtocol, nil, ErrProxyProtocolV1HeaderInvalid
+		nr, err := c.readMoreHeader(buf[n:], ErrProxyProtocolV2HeaderInvalid)
+		if err == ErrHeaderReadTimeout {
+			// client stop sending before signature complete, maybe it is waiting for server
+			return c.notProxyProtocol(buf[0:n], err)
 		}
-		endPos := pos
-		if n > endPos {
-			c.exceedBuffer = buf[endPos+1:]
-			c.exceedBufferLen = n - endPos
+		if err != nil {
+			return unknownProtocol, nil, err
+		}
+		n += nr
+	}
+	if (buf[v2CmdPos] & 0xF0) != v2Version {
+		return unknownProtocol, nil, ErrProxyProtocolV2HeaderInvalid
+	}
+	endPos := v2AddrsPos + int(binary.BigEndian.Uint16(buf[v2LenPos:v2LenPos+2]))
+	if endPos > c.maxHeaderLen() {
+		return unknownProtocol, nil, ErrHeaderTooLong
+	}
+	if n < endPos {
+		// Header with TLVs may longer than first read, so read the rest.
+		hbuf := make([]byte, endPos)
+		copy(hbuf, buf[0:n])
+		if _, err := io.ReadFull(c.Conn, hbuf[n:]); err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return unknownProtocol, nil, c.timeoutErr()
+			}
+			return unknownProtocol, nil, ErrProxyProtocolV2HeaderInvalid
+		}
+		return proxyProtocolV2, hbuf, nil
+	}
+	if n > endPos {
+		c.setExceedBuffer(buf[endPos:n])
+	}
+	return proxyProtocolV2, buf[0:endPos], nil
+}
+
+// Received data is not PROXY protocol header, use raw connection if fallbackable
+// and all received data should be read again, otherwise return err.
+func (c *proxyProtocolConn) notProxyProtocol(data []byte, err error) (int, []byte, error) {
+	if c.fallbackable {
+		c.setExceedBuffer(data)
+		return unknownProtocol, nil, nil
+	}
+	return unknownProtocol, nil, err
+}
+
+// Copy data received after header, header buffer will be reused
+func (c *proxyProtocolConn) setExceedBuffer(data []byte) {
+	c.exceedBuffer = make([]byte, len(data))
+	copy(c.exceedBuffer, data)
+	c.exceedBufferLen = len(data)
+}
+
+// Return header buffer to pool, any data in it should not be referenced
+func (c *proxyProtocolConn) releaseHeaderBuffer() {
+	if c.headerBuffer != nil {
+		headerBufferPool.Put(c.headerBuffer)
+		c.headerBuffer = nil
+	}
+}
+
+// Read part of header, return ErrHeaderReadTimeout if deadline exceeded, errHeaderReadInterrupted
+// if interrupted by AcceptContext, or invalidErr if connection closed or broken before header complete
+func (c *proxyProtocolConn) readMoreHeader(buf []byte, invalidErr error) (int, error) {
+	n, err := c.Conn.Read(buf)
+	if err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+			return 0, c.timeoutErr()
 		}
-		return proxyProtocolV1, buf[0 : endPos+1], nil
+		return 0, invalidErr
+	}
+	return n, nil
+}
+
+// Deadline is set to now when interrupted, it is not a real timeout
+func (c *proxyProtocolConn) timeoutErr() error {
+	if c.interrupted() {
+		return errHeaderReadInterrupted
+	}
+	return ErrHeaderReadTimeout
+}
+
+func (c *proxyProtocolConn) maxHeaderLen() int {
+	if c.maxHeaderBytes > 0 {
+		return c.maxHeaderBytes
+	}
+	return defaultMaxHeaderBytes
+}
+
+// Check data is beginning of sig or sig is beginning of data
+func hasSigPrefix(data []byte, sig []byte) bool {
+	n := len(data)
+	if n > len(sig) {
+		n = len(sig)
 	}
-	return unknownProtocol, nil, ErrProxyProtocolV1HeaderInvalid
+	return bytes.Equal(data[0:n], sig[0:n])
 }
@@ -1,6 +1,9 @@
 package proxyprotocol
 
-import "testing"
+import (
+	"net"
+	"testing"
+)
 
 func BenchmarkHeaderV1Parser(b *testing.B) {
 	cc := &proxyProtocolConn{
@@ -14,7 +17,7 @@ func BenchmarkHeaderV1Parser(b *testing.B) {
 	}
 	nt := len(tests)
 	for i := 0; i < b.N; i++ {
-		cc.extractClientIPV1(tests[i%nt], nil)
+		cc.extractHeaderV1(tests[i%nt])
 	}
 }
 
@@ -23,12 +26,12 @@ func BenchmarkHeaderV2Parser(b *testing.B) {
 		Conn: nil,
 	}
 	tests := [][]byte{
-		encodeProxyProtocolV2Header("tcp4", "192.168.1.100:5678", "192.168.1.5:4000"),
-		encodeProxyProtocolV2Header("tcp6", "[2001:0db8:85a3:0000:0000:8a2e:0370:7334]:5678", "[2001:db8:85a3::8a2e:370:8000]:4000"),
+		encodeProxyProtocolV2Header("tcp4", TransportStream, "192.168.1.100:5678", "192.168.1.5:4000"),
+		encodeProxyProtocolV2Header("tcp6", TransportStream, "[2001:0db8:85a3:0000:0000:8a2e:0370:7334]:5678", "[2001:db8:85a3::8a2e:370:8000]:4000"),
 	}
 	nt := len(tests)
 	for i := 0; i < b.N; i++ {
-		cc.extraceClientIPV2(tests[i%nt], nil)
+		cc.extractHeaderV2(tests[i%nt])
 	}
 }
 
@@ -36,8 +39,8 @@ func BenchmarkProtocolVersionTest(b *testing.B) {
 	tests := [][]byte{
 		[]byte("PROXY TCP4 192.168.1.100 192.168.1.50 5678 3306\r\nOther Data"),
 		[]byte("PROXY TCP6 2001:0db8:85a3:0000:0000:8a2e:0370:7334 2001:0db8:85a3:0000:0000:8a2e:0390:7334 5678 3306\r\n"),
-		encodeProxyProtocolV2Header("tcp4", "192.168.1.100:5678", "192.168.1.5:4000"),
-		encodeProxyProtocolV2Header("tcp6", "[2001:0db8:85a3:0000:0000:8a2e:0370:7334]:5678", "[2001:db8:85a3::8a2e:370:8000]:4000"),
+		encodeProxyProtocolV2Header("tcp4", TransportStream, "192.168.1.100:5678", "192.168.1.5:4000"),
+		encodeProxyProtocolV2Header("tcp6", TransportStream, "[2001:0db8:85a3:0000:0000:8a2e:0370:7334]:5678", "[2001:db8:85a3::8a2e:370:8000]:4000"),
 	}
 	nt := len(tests)
 	for i := 0; i < b.N; i++ {
@@ -46,6 +49,7 @@ func BenchmarkProtocolVersionTest(b *testing.B) {
 			Conn: newMockBufferConnBytes(data, nil),
 		}
 		cc.readHeader()
+		cc.releaseHeaderBuffer()
 	}
 }
 
@@ -53,8 +57,8 @@ func BenchmarkParseHeaderMix(b *testing.B) {
 	tests := [][]byte{
 		[]byte("PROXY TCP4 192.168.1.100 192.168.1.50 5678 3306\r\nOther Data"),
 		[]byte("PROXY TCP6 2001:0db8:85a3:0000:0000:8a2e:0370:7334 2001:0db8:85a3:0000:0000:8a2e:0390:7334 5678 3306\r\n"),
-		encodeProxyProtocolV2Header("tcp4", "192.168.1.100:5678", "192.168.1.5:4000"),
-		encodeProxyProtocolV2Header("tcp6", "[2001:0db8:85a3:0000:0000:8a2e:0370:7334]:5678", "[2001:db8:85a3::8a2e:370:8000]:4000"),
+		encodeProxyProtocolV2Header("tcp4", TransportStream, "192.168.1.100:5678", "192.168.1.5:4000"),
+		encodeProxyProtocolV2Header("tcp6", TransportStream, "[2001:0db8:85a3:0000:0000:8a2e:0370:7334]:5678", "[2001:db8:85a3::8a2e:370:8000]:4000"),
 	}
 	nt := len(tests)
 	for i := 0; i < b.N; i++ {
@@ -83,8 +87,8 @@ func BenchmarkParseHeaderV1(b *testing.B) {
 
 func BenchmarkParseHeaderV2(b *testing.B) {
 	tests := [][]byte{
-		encodeProxyProtocolV2Header("tcp4", "192.168.1.100:5678", "192.168.1.5:4000"),
-		encodeProxyProtocolV2Header("tcp6", "[2001:0db8:85a3:0000:0000:8a2e:0370:7334]:5678", "[2001:db8:85a3::8a2e:370:8000]:4000"),
+		encodeProxyProtocolV2Header("tcp4", TransportStream, "192.168.1.100:5678", "192.168.1.5:4000"),
+		encodeProxyProtocolV2Header("tcp6", TransportStream, "[2001:0db8:85a3:0000:0000:8a2e:0370:7334]:5678", "[2001:db8:85a3::8a2e:370:8000]:4000"),
 	}
 	nt := len(tests)
 	for i := 0; i < b.N; i++ {
@@ -95,3 +99,27 @@ func BenchmarkParseHeaderV2(b *testing.B) {
 		cc.readClientAddrBehindProxy(nil)
 	}
 }
+
+func BenchmarkCreateProxyProtocolConn(b *testing.B) {
+	tests := [][]byte{
+		[]byte("PROXY TCP4 192.168.1.100 192.168.1.50 5678 3306\r\nOther Data"),
+		[]byte("PROXY TCP6 2001:0db8:85a3:0000:0000:8a2e:0370:7334 2001:0db8:85a3:0000:0000:8a2e:0390:7334 5678 3306\r\n"),
+		encodeProxyProtocolV2Header("tcp4", TransportStream, "192.168.1.100:5678", "192.168.1.5:4000"),
+		appendProxyProtocolV2TLV(encodeProxyProtocolV2Header("tcp6", TransportStream, "[2001:0db8:85a3:0000:0000:8a2e:0370:7334]:5678", "[2001:db8:85a3::8a2e:370:8000]:4000"), PP2TypeAuthority, []byte("example.com")),
+	}
+	l, _ := newListener(nil, "*", 5)
+	craddr, _ := net.ResolveTCPAddr("tcp4", "192.168.1.51:8080")
+	conns := make([]*mockBufferConn, len(tests))
+	for i := range conns {
+		conns[i] = newMockBufferConnBytes(nil, craddr)
+	}
+	nt := len(tests)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn := conns[i%nt]
+		conn.Reset()
+		conn.Write(tests[i%nt])
+		l.createProxyProtocolConn(conn)
+	}
+}
@@ -0,0 +1,186 @@
+package proxyprotocol
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+)
+
+const (
+	v2MaxPayloadLen = 0xFFFF
+)
+
+// Write PROXY protocol v1 header to w
+// * src is the client address and dst is the address client connected to
+// * if src and dst are not both TCP addresses "PROXY UNKNOWN" header will be written
+// If src and dst are in different IP family both of them will be written as TCP6.
+func WriteHeaderV1(w io.Writer, src, dst net.Addr) (int, error) {
+	return w.Write(encodeHeaderV1(src, dst))
+}
+
+// Write PROXY protocol v2 header to w
+// * src is the client address and dst is the address client connected to
+// * tlvs is TLVs append after address block, key is TLV type, can be nil
+// If src and dst are not both TCP, UDP or UNIX addresses, header will be written
+// with AF_UNSPEC family so receiver will use real connection endpoints.
+// If src and dst are in different IP family both of them will be written as IPv6.
+func WriteHeaderV2(w io.Writer, src, dst net.Addr, tlvs map[byte][]byte) (int, error) {
+	buffer, err := encodeHeaderV2(src, dst, tlvs)
+	if err != nil {
+		return 0, err
+	}
+	return w.Write(buffer)
+}
+
+func encodeHeaderV1(src, dst net.Addr) []byte {
+	saddr, sok := src.(*net.TCPAddr)
+	daddr, dok := dst.(*net.TCPAddr)
+	if !sok || !dok || saddr == nil || daddr == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	sip, dip, isV4 := normalizeIPs(saddr.IP, daddr.IP)
+	if sip == nil || dip == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	buffer := make([]byte, 0, proxyProtocolV1MaxHeaderLen)
+	if isV4 {
+		buffer = append(buffer, "PROXY TCP4 "...)
+	} else {
+		buffer = append(buffer, "PROXY TCP6 "...)
+	}
+	buffer = appendIPV1(buffer, sip, isV4)
+	buffer = append(buffer, ' ')
+	buffer = appendIPV1(buffer, dip, isV4)
+	buffer = append(buffer, ' ')
+	buffer = strconv.AppendInt(buffer, int64(saddr.Port), 10)
+	buffer = append(buffer, ' ')
+	buffer = strconv.AppendInt(buffer, int64(daddr.Port), 10)
+	buffer = append(buffer, "\r\n"...)
+	return buffer
+}
+
+// net.IP.String will output IPv4-mapped IPv6 address as IPv4 address,
+// but TCP6 header requires IPv6 address.
+func appendIPV1(buffer []byte, ip net.IP, isV4 bool) []byte {
+	if ip4 := ip.To4(); !isV4 && ip4 != nil {
+		buffer = append(buffer, "::ffff:"...)
+		return append(buffer, ip4.String()...)
+	}
+	return append(buffer, ip.String()...)
+}
+
+func encodeHeaderV2(src, dst net.Addr, tlvs map[byte][]byte) ([]byte, error) {
+	var (
+		famly byte = AFUnspec | TransportUnspec
+		sip   net.IP
+		dip   net.IP
+		sport int
+		dport int
+		isV4  bool
+	)
+	switch saddr := src.(type) {
+	case *net.TCPAddr:
+		if daddr, ok := dst.(*net.TCPAddr); ok && saddr != nil && daddr != nil {
+			sip, dip, isV4 = normalizeIPs(saddr.IP, daddr.IP)
+			sport, dport = saddr.Port, daddr.Port
+			famly = TransportStream
+		}
+	case *net.UDPAddr:
+		if daddr, ok := dst.(*net.UDPAddr); ok && saddr != nil && daddr != nil {
+			sip, dip, isV4 = normalizeIPs(saddr.IP, daddr.IP)
+			sport, dport = saddr.Port, daddr.Port
+			famly = TransportDgram
+		}
+	case *net.UnixAddr:
+		if daddr, ok := dst.(*net.UnixAddr); ok && saddr != nil && daddr != nil {
+			return encodeUnixHeaderV2(saddr, daddr, tlvs)
+		}
+	}
+
+	addrsLen := 0
+	if sip == nil || dip == nil {
+		famly = AFUnspec | TransportUnspec
+	} else if isV4 {
+		famly |= AFInet
+		addrsLen = v2IPv4AddrsLen
+	} else {
+		famly |= AFInet6
+		addrsLen = v2IPv6AddrsLen
+	}
+
+	buffer, err := newHeaderBufferV2(famly, addrsLen, tlvs)
+	if err != nil {
+		return nil, err
+	}
+	if addrsLen > 0 {
+		ipLen := len(sip)
+		copy(buffer[v2AddrsPos:], sip)
+		copy(buffer[v2AddrsPos+ipLen:], dip)
+		binary.BigEndian.PutUint16(buffer[v2AddrsPos+2*ipLen:], uint16(sport))
+		binary.BigEndian.PutUint16(buffer[v2AddrsPos+2*ipLen+2:], uint16(dport))
+	}
+	return appendTLVsV2(buffer, tlvs), nil
+}
+
+func encodeUnixHeaderV2(src, dst *net.UnixAddr, tlvs map[byte][]byte) ([]byte, error) {
+	// Path should be terminated by NUL byte
+	if len(src.Name) >= v2UnixPathLen || len(dst.Name) >= v2UnixPathLen {
+		return nil, ErrProxyProtocolV2HeaderInvalid
+	}
+	var famly byte = AFUnix | TransportStream
+	if src.Net == "unixgram" {
+		famly = AFUnix | TransportDgram
+	}
+	buffer, err := newHeaderBufferV2(famly, v2UnixAddrsLen, tlvs)
+	if err != nil {
+		return nil, err
+	}
+	copy(buffer[v2AddrsPos:], src.Name)
+	copy(buffer[v2AddrsPos+v2UnixPathLen:], dst.Name)
+	return appendTLVsV2(buffer, tlvs), nil
+}
+
+// Create header buffer contains signature, command, family, length and
+// zeroed address block, capacity is enough to append TLVs.
+func newHeaderBufferV2(famly byte, addrsLen int, tlvs map[byte][]byte) ([]byte, error) {
+	payloadLen := addrsLen
+	for _, value := range tlvs {
+		payloadLen += v2TLVHeaderLen + len(value)
+	}
+	if payloadLen > v2MaxPayloadLen {
+		return nil, ErrProxyProtocolV2HeaderInvalid
+	}
+
+	buffer := make([]byte, v2AddrsPos+addrsLen, v2AddrsPos+payloadLen)
+	copy(buffer, proxyProtocolV2Sig)
+	buffer[v2CmdPos] = v2Version | CommandProxy
+	buffer[v2FamlyPos] = famly
+	binary.BigEndian.PutUint16(buffer[v2LenPos:v2LenPos+2], uint16(payloadLen))
+	return buffer, nil
+}
+
+func appendTLVsV2(buffer []byte, tlvs map[byte][]byte) []byte {
+	// Sort TLV types to make output stable
+	types := make([]int, 0, len(tlvs))
+	for typ := range tlvs {
+		types = append(types, int(typ))
+	}
+	sort.Ints(types)
+	for _, typ := range types {
+		value := tlvs[byte(typ)]
+		buffer = append(buffer, byte(typ), byte(len(value)>>8), byte(len(value)))
+		buffer = append(buffer, value...)
+	}
+	return buffer
+}
+
+// Convert src and dst IP to the same family, return nil IPs if any of them is invalid
+func normalizeIPs(src, dst net.IP) (net.IP, net.IP, bool) {
+	sip4, dip4 := src.To4(), dst.To4()
+	if sip4 != nil && dip4 != nil {
+		return sip4, dip4, true
+	}
+	return src.To16(), dst.To16(), false
+}
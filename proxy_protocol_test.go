@@ -2,10 +2,15 @@ package proxyprotocol
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"io"
 	"net"
+	"os"
 	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -58,6 +63,32 @@ func (c *mockBufferConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
+// mockChunkConn returns at most chunkSize bytes for each read
+type mockChunkConn struct {
+	*mockBufferConn
+	chunkSize int
+}
+
+func (c *mockChunkConn) Read(buf []byte) (int, error) {
+	if len(buf) > c.chunkSize {
+		buf = buf[0:c.chunkSize]
+	}
+	return c.mockBufferConn.Read(buf)
+}
+
+// mockTimeoutConn returns timeout error instead of EOF when all data is read,
+// just like client is waiting for server
+type mockTimeoutConn struct {
+	*mockChunkConn
+}
+
+func (c *mockTimeoutConn) Read(buf []byte) (int, error) {
+	if c.Len() == 0 {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.mockChunkConn.Read(buf)
+}
+
 func assertTrue(t *testing.T, val bool) {
 	if !val {
 		t.Errorf("Expect true but got: %v", val)
@@ -102,6 +133,49 @@ func TestProxyProtocolConnCheckAllowed(t *testing.T) {
 	}
 }
 
+func TestProxyProtocolConnCheckAllowedIPv6(t *testing.T) {
+	tests := []struct {
+		allowedIPs string
+		addr       string
+		expected   bool
+	}{
+		{"2001:db8::/32", "[2001:db8:85a3::8a2e:370:7334]:8080", true},
+		{"2001:db8::/32", "[2001:db9::1]:8080", false},
+		{"2001:db8::1", "[2001:db8::1]:8080", true},
+		{"2001:db8::1", "[2001:db8::2]:8080", false},
+		{"192.168.1.0/24,2001:db8::/32", "192.168.1.100:8080", true},
+		{"192.168.1.0/24,2001:db8::/32", "[2001:db8::1]:8080", true},
+		{"192.168.1.0/24,2001:db8::/32", "192.168.2.100:8080", false},
+		{"192.168.1.0/24,2001:db8::/32", "[2001:db9::1]:8080", false},
+		// IPv4 client should not match IPv6 network
+		{"::/0", "192.168.1.100:8080", false},
+		// IPv6 client should not match IPv4 network
+		{"0.0.0.0/0", "[2001:db8::1]:8080", false},
+		// IPv4-mapped IPv6 client match IPv4 network
+		{"192.168.1.0/24", "[::ffff:192.168.1.100]:8080", true},
+		{"192.168.1.0/24", "[::ffff:192.168.2.100]:8080", false},
+		// IPv4-mapped IPv6 network match IPv4 client
+		{"::ffff:192.168.1.0/120", "192.168.1.100:8080", true},
+		{"::ffff:192.168.1.100", "192.168.1.100:8080", true},
+		{"::ffff:192.168.1.100", "[::ffff:192.168.1.100]:8080", true},
+		{"::ffff:192.168.1.0/120", "192.168.2.100:8080", false},
+	}
+	for _, test := range tests {
+		l, err := newListener(nil, test.allowedIPs, 5)
+		assertNil(t, err)
+		raddr, err := net.ResolveTCPAddr("tcp", test.addr)
+		assertNil(t, err)
+		if l.checkAllowed(raddr) != test.expected {
+			t.Errorf("Allowed: %s Address: %s Expect: %v", test.allowedIPs, test.addr, test.expected)
+		}
+	}
+
+	for _, allowedIPs := range []string{"2001:db8::/129", "2001:db8::zz", "192.168.1.0/24,"} {
+		_, err := newListener(nil, allowedIPs, 5)
+		assertTrue(t, err != nil)
+	}
+}
+
 func TestProxyProtocolConnMustNotReadAnyDataAfterCLRF(t *testing.T) {
 	buffer := []byte("PROXY TCP4 192.168.1.100 192.168.1.50 5678 3306\r\nOther Data")
 	conn := newMockBufferConn(bytes.NewBuffer(buffer), nil)
@@ -135,15 +209,14 @@ func TestProxyProtocolConnMustNotReadAnyDataAfterCLRF(t *testing.T) {
 	conn = newMockBufferConn(bytes.NewBuffer(buffer), nil)
 	wconn, err = l.createProxyProtocolConn(conn)
 	assertNil(t, err)
-	buf = make([]byte, 1024)
-	n, err = wconn.Read(buf)
+	data, err := io.ReadAll(wconn)
 	assertNil(t, err)
-	assertEquals(t, string(buf[0:n]), expectedString)
+	assertEquals(t, string(data), expectedString)
 }
 
 func TestProxyProtocolV2ConnMustNotReadAnyDataAfterHeader(t *testing.T) {
 	craddr, _ := net.ResolveTCPAddr("tcp4", "192.168.1.51:8080")
-	buffer := encodeProxyProtocolV2Header("tcp4", "192.168.1.100:5678", "192.168.1.5:4000")
+	buffer := encodeProxyProtocolV2Header("tcp4", TransportStream, "192.168.1.100:5678", "192.168.1.5:4000")
 	expectedString := "Other Data"
 	buffer = append(buffer, []byte(expectedString)...)
 	l, _ := newListener(nil, "*", 5)
@@ -155,13 +228,51 @@ func TestProxyProtocolV2ConnMustNotReadAnyDataAfterHeader(t *testing.T) {
 	assertEquals(t, string(buf[0:n]), expectedString)
 }
 
+func TestProxyProtocolConnFallback(t *testing.T) {
+	craddr, _ := net.ResolveTCPAddr("tcp4", "192.168.1.51:8080")
+	tests := []string{
+		"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"H",
+		"PROXX TCP4 192.168.1.100 192.168.1.50 5678 3306\r\n",
+		"\r\n\r\n\x00\r\nQUIX\n",
+		"POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 100\r\n\r\n" + strings.Repeat("a", 100),
+	}
+
+	l, _ := newListener(nil, "*", 5)
+	l.fallbackable = true
+	for _, test := range tests {
+		conn := newMockBufferConn(bytes.NewBuffer([]byte(test)), craddr)
+		wconn, err := l.createProxyProtocolConn(conn)
+		if err != nil {
+			t.Errorf("Buffer:%s\nExpect fallback Got Error: %v", test, err)
+			continue
+		}
+		assertEquals(t, wconn.RemoteAddr().String(), craddr.String())
+		data, err := io.ReadAll(wconn)
+		assertNil(t, err)
+		assertEquals(t, string(data), test)
+	}
+
+	// Data look like PROXY protocol should still be checked
+	for _, test := range []string{"PROXY TCP4 192.168.1.100\r\n", "PROXY TCP4 192.168.1.100 192.168.1.50 5678 3306"} {
+		conn := newMockBufferConn(bytes.NewBuffer([]byte(test)), craddr)
+		_, err := l.createProxyProtocolConn(conn)
+		assertTrue(t, err == ErrProxyProtocolV1HeaderInvalid)
+	}
+	buffer := []byte("PROXY TCP4 192.168.1.100 192.168.1.50 5678 3306\r\nOther Data")
+	conn := newMockBufferConn(bytes.NewBuffer(buffer), craddr)
+	wconn, err := l.createProxyProtocolConn(conn)
+	assertNil(t, err)
+	assertEquals(t, wconn.RemoteAddr().String(), "192.168.1.100:5678")
+}
+
 func TestProxyProtocolV1HeaderRead(t *testing.T) {
 	buffer := []byte("PROXY TCP4 192.168.1.100 192.168.1.50 5678 3306\r\nOther Data")
 	expectedString := "PROXY TCP4 192.168.1.100 192.168.1.50 5678 3306\r\n"
 	conn := newMockBufferConn(bytes.NewBuffer(buffer), nil)
 	wconn := &proxyProtocolConn{
 		Conn:              conn,
-		headerReadTimeout: 5,
+		headerReadTimeout: 5 * time.Second,
 	}
 	ver, buf, err := wconn.readHeader()
 	assertNil(t, err)
@@ -246,29 +357,86 @@ func TestProxyProtocolV1ExtractClientIP(t *testing.T) {
 	}
 }
 
-func encodeProxyProtocolV2Header(network, srcAddr, dstAddr string) []byte {
+func TestProxyProtocolV1HeaderInvalid(t *testing.T) {
+	craddr, _ := net.ResolveTCPAddr("tcp4", "192.168.1.51:8080")
+	tests := []string{
+		// port out of range
+		"PROXY TCP4 192.168.1.100 192.168.1.50 99999 3306\r\n",
+		"PROXY TCP4 192.168.1.100 192.168.1.50 5678 65536\r\n",
+		// port is not decimal digits
+		"PROXY TCP4 192.168.1.100 192.168.1.50 +5678 3306\r\n",
+		"PROXY TCP4 192.168.1.100 192.168.1.50 5678 -1\r\n",
+		"PROXY TCP4 192.168.1.100 192.168.1.50 5678 0x10\r\n",
+		"PROXY TCP4 192.168.1.100 192.168.1.50 005678 3306\r\n",
+		// extra whitespace between fields
+		"PROXY  TCP4 192.168.1.100 192.168.1.50 5678 3306\r\n",
+		"PROXY TCP4 192.168.1.100  192.168.1.50 5678 3306\r\n",
+		"PROXY TCP4 192.168.1.100 192.168.1.50 5678 3306 \r\n",
+		"PROXY TCP4 192.168.1.100 192.168.1.50 5678\t3306\r\n",
+		// wrong number of fields
+		"PROXY TCP4 192.168.1.100 192.168.1.50 5678\r\n",
+		"PROXY TCP6 2001:db8::1 2001:db8::2 5678 3306 3307\r\n",
+		"PROXY\r\n",
+		// address not match the family
+		"PROXY TCP4 2001:db8::1 2001:db8::2 5678 3306\r\n",
+		"PROXY TCP6 192.168.1.100 192.168.1.50 5678 3306\r\n",
+		"PROXY TCP4 192.168.1.100 2001:db8::2 5678 3306\r\n",
+		// invalid address
+		"PROXY TCP4 192.168.1.300 192.168.1.50 5678 3306\r\n",
+		// line end is not CRLF
+		"PROXY TCP4 192.168.1.100 192.168.1.50 5678 3306\n",
+	}
+
+	l, _ := newListener(nil, "*", 5)
+	for _, test := range tests {
+		conn := newMockBufferConn(bytes.NewBuffer([]byte(test)), craddr)
+		_, err := l.createProxyProtocolConn(conn)
+		if err != ErrProxyProtocolV1HeaderInvalid {
+			t.Errorf("Buffer:%q\nExpect Error: %v Got: %v", test, ErrProxyProtocolV1HeaderInvalid, err)
+		}
+	}
+
+	// Port 0 and 65535 are in range
+	conn := newMockBufferConn(bytes.NewBuffer([]byte("PROXY TCP4 192.168.1.100 192.168.1.50 0 65535\r\n")), craddr)
+	wconn, err := l.createProxyProtocolConn(conn)
+	assertNil(t, err)
+	assertEquals(t, wconn.RemoteAddr().String(), "192.168.1.100:0")
+	assertEquals(t, wconn.LocalAddr().String(), "192.168.1.50:65535")
+}
+
+func encodeProxyProtocolV2Header(network string, transport byte, srcAddr, dstAddr string) []byte {
+	if network == "unix" {
+		buffer := make([]byte, v2AddrsPos+v2UnixAddrsLen)
+		copy(buffer, proxyProtocolV2Sig)
+		buffer[v2CmdPos] = v2Version | CommandProxy
+		buffer[v2FamlyPos] = AFUnix | transport
+		binary.BigEndian.PutUint16(buffer[14:14+2], v2UnixAddrsLen)
+		copy(buffer[v2AddrsPos:v2AddrsPos+v2UnixPathLen], srcAddr)
+		copy(buffer[v2AddrsPos+v2UnixPathLen:], dstAddr)
+		return buffer
+	}
 	saddr, _ := net.ResolveTCPAddr(network, srcAddr)
 	daddr, _ := net.ResolveTCPAddr(network, dstAddr)
 	buffer := make([]byte, 1024)
 	copy(buffer, proxyProtocolV2Sig)
 	// Command
-	buffer[v2CmdPos] = 0x21
+	buffer[v2CmdPos] = v2Version | CommandProxy
 	// Famly
 	if network == "tcp4" {
-		buffer[v2FamlyPos] = 0x11
+		buffer[v2FamlyPos] = AFInet | transport
 		binary.BigEndian.PutUint16(buffer[14:14+2], 12)
 		copy(buffer[16:16+4], []byte(saddr.IP.To4()))
 		copy(buffer[20:20+4], []byte(daddr.IP.To4()))
 		binary.BigEndian.PutUint16(buffer[24:24+2], uint16(saddr.Port))
-		binary.BigEndian.PutUint16(buffer[26:26+2], uint16(saddr.Port))
+		binary.BigEndian.PutUint16(buffer[26:26+2], uint16(daddr.Port))
 		return buffer[0:28]
 	} else if network == "tcp6" {
-		buffer[v2FamlyPos] = 0x21
+		buffer[v2FamlyPos] = AFInet6 | transport
 		binary.BigEndian.PutUint16(buffer[14:14+2], 36)
 		copy(buffer[16:16+16], []byte(saddr.IP.To16()))
 		copy(buffer[32:32+16], []byte(daddr.IP.To16()))
 		binary.BigEndian.PutUint16(buffer[48:48+2], uint16(saddr.Port))
-		binary.BigEndian.PutUint16(buffer[50:50+2], uint16(saddr.Port))
+		binary.BigEndian.PutUint16(buffer[50:50+2], uint16(daddr.Port))
 		return buffer[0:52]
 	}
 	return buffer
@@ -277,16 +445,29 @@ func encodeProxyProtocolV2Header(network, srcAddr, dstAddr string) []byte {
 func TestProxyProtocolV2HeaderRead(t *testing.T) {
 	craddr, _ := net.ResolveTCPAddr("tcp4", "192.168.1.51:8080")
 	tests := []struct {
-		buffer     []byte
-		expectedIP string
+		buffer          []byte
+		expectedIP      string
+		expectedNetwork string
 	}{
 		{
-			buffer:     encodeProxyProtocolV2Header("tcp4", "192.168.1.100:5678", "192.168.1.5:4000"),
-			expectedIP: "192.168.1.100:5678",
+			buffer:          encodeProxyProtocolV2Header("tcp4", TransportStream, "192.168.1.100:5678", "192.168.1.5:4000"),
+			expectedIP:      "192.168.1.100:5678",
+			expectedNetwork: "tcp",
 		},
 		{
-			buffer:     encodeProxyProtocolV2Header("tcp6", "[2001:db8:85a3::8a2e:370:7334]:5678", "[2001:db8:85a3::8a2e:370:8000]:4000"),
-			expectedIP: "[2001:db8:85a3::8a2e:370:7334]:5678",
+			buffer:          encodeProxyProtocolV2Header("tcp6", TransportStream, "[2001:db8:85a3::8a2e:370:7334]:5678", "[2001:db8:85a3::8a2e:370:8000]:4000"),
+			expectedIP:      "[2001:db8:85a3::8a2e:370:7334]:5678",
+			expectedNetwork: "tcp",
+		},
+		{
+			buffer:          encodeProxyProtocolV2Header("tcp4", TransportDgram, "192.168.1.100:5678", "192.168.1.5:4000"),
+			expectedIP:      "192.168.1.100:5678",
+			expectedNetwork: "udp",
+		},
+		{
+			buffer:          encodeProxyProtocolV2Header("tcp6", TransportDgram, "[2001:db8:85a3::8a2e:370:7334]:5678", "[2001:db8:85a3::8a2e:370:8000]:4000"),
+			expectedIP:      "[2001:db8:85a3::8a2e:370:7334]:5678",
+			expectedNetwork: "udp",
 		},
 	}
 
@@ -294,19 +475,171 @@ func TestProxyProtocolV2HeaderRead(t *testing.T) {
 	for _, test := range tests {
 		conn := newMockBufferConn(bytes.NewBuffer(test.buffer), craddr)
 		wconn, err := l.createProxyProtocolConn(conn)
-		clientIP := wconn.RemoteAddr()
 		if err == nil {
-			assertEquals(t, clientIP.String(), test.expectedIP, "Buffer:%v\nExpect: %s Got: %s", test.buffer, test.expectedIP, clientIP.String())
+			clientIP := wconn.RemoteAddr()
+			assertEquals(t, clientIP.String(), test.expectedIP)
+			assertEquals(t, clientIP.Network(), test.expectedNetwork)
 		} else {
 			t.Errorf("Buffer:%v\nExpect: %s Got Error: %v", test.buffer, test.expectedIP, err)
 		}
 	}
 }
 
+func TestProxyProtocolV2HeaderReadUnix(t *testing.T) {
+	craddr, _ := net.ResolveTCPAddr("tcp4", "192.168.1.51:8080")
+	longPath := "/" + strings.Repeat("a", v2UnixPathLen-1)
+	tests := []struct {
+		buffer          []byte
+		expectedAddr    string
+		expectedNetwork string
+	}{
+		{
+			buffer:          encodeProxyProtocolV2Header("unix", TransportStream, "/var/run/src.sock", "/var/run/dst.sock"),
+			expectedAddr:    "/var/run/src.sock",
+			expectedNetwork: "unix",
+		},
+		{
+			buffer:          encodeProxyProtocolV2Header("unix", TransportDgram, "/var/run/src.sock", "/var/run/dst.sock"),
+			expectedAddr:    "/var/run/src.sock",
+			expectedNetwork: "unixgram",
+		},
+		{
+			// path use all 108 bytes without NUL terminator
+			buffer:          encodeProxyProtocolV2Header("unix", TransportStream, longPath, "/var/run/dst.sock"),
+			expectedAddr:    longPath,
+			expectedNetwork: "unix",
+		},
+		{
+			// empty source path use connection address
+			buffer:          encodeProxyProtocolV2Header("unix", TransportStream, "", "/var/run/dst.sock"),
+			expectedAddr:    craddr.String(),
+			expectedNetwork: "tcp",
+		},
+	}
+
+	l, _ := newListener(nil, "*", 5)
+	for _, test := range tests {
+		conn := newMockBufferConn(bytes.NewBuffer(test.buffer), craddr)
+		wconn, err := l.createProxyProtocolConn(conn)
+		if err != nil {
+			t.Errorf("Buffer:%v\nExpect: %s Got Error: %v", test.buffer, test.expectedAddr, err)
+			continue
+		}
+		assertEquals(t, wconn.RemoteAddr().String(), test.expectedAddr)
+		assertEquals(t, wconn.RemoteAddr().Network(), test.expectedNetwork)
+	}
+
+	// Length field is shorter than UNIX address block
+	buffer := encodeProxyProtocolV2Header("unix", TransportStream, "/var/run/src.sock", "/var/run/dst.sock")
+	binary.BigEndian.PutUint16(buffer[v2LenPos:v2LenPos+2], v2UnixPathLen)
+	conn := newMockBufferConn(bytes.NewBuffer(buffer[0:v2AddrsPos+v2UnixPathLen]), craddr)
+	_, err := l.createProxyProtocolConn(conn)
+	assertTrue(t, err == ErrProxyProtocolV2HeaderInvalid)
+}
+
+func TestProxyProtocolV2HeaderReadInvalidTransport(t *testing.T) {
+	craddr, _ := net.ResolveTCPAddr("tcp4", "192.168.1.51:8080")
+	l, _ := newListener(nil, "*", 5)
+	for _, transport := range []byte{0x00, 0x03, 0x0F} {
+		buffer := encodeProxyProtocolV2Header("tcp4", transport, "192.168.1.100:5678", "192.168.1.5:4000")
+		conn := newMockBufferConn(bytes.NewBuffer(buffer), craddr)
+		_, err := l.createProxyProtocolConn(conn)
+		if err != ErrProxyProtocolV2HeaderInvalid {
+			t.Errorf("Buffer:%v\nExpect Error: %v Got: %v", buffer, ErrProxyProtocolV2HeaderInvalid, err)
+		}
+	}
+}
+
+func appendProxyProtocolV2TLV(buffer []byte, typ byte, value []byte) []byte {
+	tlv := make([]byte, 3, 3+len(value))
+	tlv[0] = typ
+	binary.BigEndian.PutUint16(tlv[1:3], uint16(len(value)))
+	tlv = append(tlv, value...)
+	buffer = append(buffer, tlv...)
+	binary.BigEndian.PutUint16(buffer[v2LenPos:v2LenPos+2], uint16(len(buffer)-v2AddrsPos))
+	return buffer
+}
+
+func TestProxyProtocolV2HeaderReadTLVs(t *testing.T) {
+	craddr, _ := net.ResolveTCPAddr("tcp4", "192.168.1.51:8080")
+	buffer := encodeProxyProtocolV2Header("tcp4", TransportStream, "192.168.1.100:5678", "192.168.1.5:4000")
+	buffer = appendProxyProtocolV2TLV(buffer, PP2TypeALPN, []byte("h2"))
+	buffer = appendProxyProtocolV2TLV(buffer, PP2TypeAuthority, []byte("example.com"))
+	cn := []byte(strings.Repeat("a", 100) + ".example.com")
+	ssl := []byte{PP2ClientSSL | PP2ClientCertConn, 0, 0, 0, 0}
+	ssl = append(ssl, PP2SubtypeSSLVersion, 0, 7)
+	ssl = append(ssl, []byte("TLSv1.3")...)
+	ssl = append(ssl, PP2SubtypeSSLCN, 0, byte(len(cn)))
+	ssl = append(ssl, cn...)
+	buffer = appendProxyProtocolV2TLV(buffer, PP2TypeSSL, ssl)
+	expectedString := "Other Data"
+	buffer = append(buffer, []byte(expectedString)...)
+
+	l, _ := newListener(nil, "*", 5)
+	conn := newMockBufferConn(bytes.NewBuffer(buffer), craddr)
+	wconn, err := l.createProxyProtocolConn(conn)
+	assertNil(t, err)
+	assertEquals(t, wconn.RemoteAddr().String(), "192.168.1.100:5678")
+	assertEquals(t, len(wconn.TLVs()), 3)
+	assertEquals(t, string(wconn.ALPN()), "h2")
+	assertEquals(t, wconn.Authority(), "example.com")
+	sslInfo := wconn.SSL()
+	assertTrue(t, sslInfo != nil)
+	assertTrue(t, sslInfo.Verified())
+	assertEquals(t, sslInfo.Client, PP2ClientSSL|PP2ClientCertConn)
+	assertEquals(t, sslInfo.Version(), "TLSv1.3")
+	assertEquals(t, sslInfo.CommonName(), string(cn))
+	buf := make([]byte, len(expectedString))
+	n, err := wconn.Read(buf)
+	assertNil(t, err)
+	assertEquals(t, string(buf[0:n]), expectedString)
+}
+
+func TestProxyProtocolV2HeaderReadInvalidTLVs(t *testing.T) {
+	craddr, _ := net.ResolveTCPAddr("tcp4", "192.168.1.51:8080")
+	buildHeader := func(tlvs ...[]byte) []byte {
+		buffer := encodeProxyProtocolV2Header("tcp4", TransportStream, "192.168.1.100:5678", "192.168.1.5:4000")
+		for _, tlv := range tlvs {
+			buffer = append(buffer, tlv...)
+		}
+		binary.BigEndian.PutUint16(buffer[v2LenPos:v2LenPos+2], uint16(len(buffer)-v2AddrsPos))
+		return buffer
+	}
+	tests := [][]byte{
+		// TLV value shorter than declared length
+		buildHeader([]byte{PP2TypeAuthority, 0, 10, 'a', 'b'}),
+		// Second TLV truncated
+		buildHeader([]byte{PP2TypeALPN, 0, 2, 'h', '2'}, []byte{PP2TypeAuthority, 0, 10}),
+		// TLV header truncated
+		buildHeader([]byte{PP2TypeAuthority, 0}),
+		// SSL TLV shorter than client and verify fields
+		buildHeader([]byte{PP2TypeSSL, 0, 3, PP2ClientSSL, 0, 0}),
+		// SSL sub TLV value shorter than declared length
+		buildHeader([]byte{PP2TypeSSL, 0, 9, PP2ClientSSL, 0, 0, 0, 0, PP2SubtypeSSLCN, 0, 5, 'a'}),
+	}
+	// Header length is larger than data received
+	buffer := buildHeader([]byte{PP2TypeALPN, 0, 2, 'h', '2'})
+	binary.BigEndian.PutUint16(buffer[v2LenPos:v2LenPos+2], uint16(len(buffer)-v2AddrsPos+200))
+	tests = append(tests, buffer)
+	// Header length is smaller than address block
+	buffer = buildHeader()
+	binary.BigEndian.PutUint16(buffer[v2LenPos:v2LenPos+2], 4)
+	tests = append(tests, buffer)
+
+	l, _ := newListener(nil, "*", 5)
+	for _, buffer := range tests {
+		conn := newMockBufferConn(bytes.NewBuffer(buffer), craddr)
+		_, err := l.createProxyProtocolConn(conn)
+		if err != ErrProxyProtocolV2HeaderInvalid {
+			t.Errorf("Buffer:%v\nExpect Error: %v Got: %v", buffer, ErrProxyProtocolV2HeaderInvalid, err)
+		}
+	}
+}
+
 func TestProxyProtocolV2HeaderReadLocalCommand(t *testing.T) {
 	craddr, _ := net.ResolveTCPAddr("tcp4", "192.168.1.51:8080")
-	buffer := encodeProxyProtocolV2Header("tcp4", "192.168.1.100:5678", "192.168.1.5:4000")
-	buffer[v2CmdPos] = 0x20
+	buffer := encodeProxyProtocolV2Header("tcp4", TransportStream, "192.168.1.100:5678", "192.168.1.5:4000")
+	buffer[v2CmdPos] = v2Version | CommandLocal
 	l, _ := newListener(nil, "*", 5)
 	conn := newMockBufferConn(bytes.NewBuffer(buffer), craddr)
 	wconn, err := l.createProxyProtocolConn(conn)
@@ -315,6 +648,306 @@ func TestProxyProtocolV2HeaderReadLocalCommand(t *testing.T) {
 	assertEquals(t, clientIP.String(), craddr.String(), "Buffer:%v\nExpected: %s Got: %s", buffer, craddr.String(), clientIP.String())
 }
 
+func TestProxyProtocolWriteHeaderRoundTrip(t *testing.T) {
+	craddr, _ := net.ResolveTCPAddr("tcp4", "192.168.1.51:8080")
+	tcp4Src, _ := net.ResolveTCPAddr("tcp4", "192.168.1.100:5678")
+	tcp4Dst, _ := net.ResolveTCPAddr("tcp4", "192.168.1.5:4000")
+	tcp6Src, _ := net.ResolveTCPAddr("tcp6", "[2001:db8:85a3::8a2e:370:7334]:5678")
+	tcp6Dst, _ := net.ResolveTCPAddr("tcp6", "[2001:db8:85a3::8a2e:370:8000]:4000")
+	udp4Src, _ := net.ResolveUDPAddr("udp4", "192.168.1.100:5678")
+	udp4Dst, _ := net.ResolveUDPAddr("udp4", "192.168.1.5:4000")
+	tests := []struct {
+		version         int
+		src             net.Addr
+		dst             net.Addr
+		tlvs            map[byte][]byte
+		expectedHeader  string
+		expectedIP      string
+		expectedNetwork string
+	}{
+		{1, tcp4Src, tcp4Dst, nil, "PROXY TCP4 192.168.1.100 192.168.1.5 5678 4000\r\n", "192.168.1.100:5678", "tcp"},
+		{1, tcp6Src, tcp6Dst, nil, "PROXY TCP6 2001:db8:85a3::8a2e:370:7334 2001:db8:85a3::8a2e:370:8000 5678 4000\r\n", "[2001:db8:85a3::8a2e:370:7334]:5678", "tcp"},
+		{1, tcp4Src, tcp6Dst, nil, "PROXY TCP6 ::ffff:192.168.1.100 2001:db8:85a3::8a2e:370:8000 5678 4000\r\n", "192.168.1.100:5678", "tcp"},
+		{1, udp4Src, udp4Dst, nil, "PROXY UNKNOWN\r\n", "192.168.1.51:8080", "tcp"},
+		{1, nil, nil, nil, "PROXY UNKNOWN\r\n", "192.168.1.51:8080", "tcp"},
+		{2, tcp4Src, tcp4Dst, nil, "", "192.168.1.100:5678", "tcp"},
+		{2, tcp6Src, tcp6Dst, nil, "", "[2001:db8:85a3::8a2e:370:7334]:5678", "tcp"},
+		{2, udp4Src, udp4Dst, nil, "", "192.168.1.100:5678", "udp"},
+		{2, tcp4Src, tcp4Dst, map[byte][]byte{PP2TypeAuthority: []byte("example.com"), PP2TypeALPN: []byte("h2")}, "", "192.168.1.100:5678", "tcp"},
+		{2, tcp4Src, udp4Dst, nil, "", "192.168.1.51:8080", "tcp"},
+		{2, &net.UnixAddr{Name: "/var/run/src.sock", Net: "unix"}, &net.UnixAddr{Name: "/var/run/dst.sock", Net: "unix"}, nil, "", "/var/run/src.sock", "unix"},
+	}
+
+	l, _ := newListener(nil, "*", 5)
+	for _, test := range tests {
+		var (
+			buffer bytes.Buffer
+			n      int
+			err    error
+		)
+		if test.version == 1 {
+			n, err = WriteHeaderV1(&buffer, test.src, test.dst)
+			assertEquals(t, buffer.String(), test.expectedHeader)
+		} else {
+			n, err = WriteHeaderV2(&buffer, test.src, test.dst, test.tlvs)
+		}
+		assertNil(t, err)
+		assertEquals(t, n, buffer.Len())
+		conn := newMockBufferConn(&buffer, craddr)
+		wconn, err := l.createProxyProtocolConn(conn)
+		if err != nil {
+			t.Errorf("Header:%v\nExpect: %s Got Error: %v", buffer.Bytes(), test.expectedIP, err)
+			continue
+		}
+		assertEquals(t, wconn.RemoteAddr().String(), test.expectedIP)
+		assertEquals(t, wconn.RemoteAddr().Network(), test.expectedNetwork)
+		assertEquals(t, len(wconn.TLVs()), len(test.tlvs))
+		for typ, value := range test.tlvs {
+			assertEquals(t, string(wconn.TLVs()[typ]), string(value))
+		}
+	}
+}
+
+func TestProxyProtocolWriteHeaderV2TooLong(t *testing.T) {
+	src, _ := net.ResolveTCPAddr("tcp4", "192.168.1.100:5678")
+	dst, _ := net.ResolveTCPAddr("tcp4", "192.168.1.5:4000")
+	var buffer bytes.Buffer
+	n, err := WriteHeaderV2(&buffer, src, dst, map[byte][]byte{PP2TypeNoop: make([]byte, 0xFFFF)})
+	assertEquals(t, n, 0)
+	assertEquals(t, buffer.Len(), 0)
+	assertTrue(t, err == ErrProxyProtocolV2HeaderInvalid)
+}
+
+func TestProxyProtocolLocalAddr(t *testing.T) {
+	craddr, _ := net.ResolveTCPAddr("tcp4", "192.168.1.51:8080")
+	localCmd := encodeProxyProtocolV2Header("tcp4", TransportStream, "192.168.1.100:5678", "192.168.1.5:4000")
+	localCmd[v2CmdPos] = v2Version | CommandLocal
+	tests := []struct {
+		buffer          []byte
+		expectedAddr    string
+		expectedNetwork string
+	}{
+		{
+			buffer:          []byte("PROXY TCP4 192.168.1.100 192.168.1.50 5678 3306\r\n"),
+			expectedAddr:    "192.168.1.50:3306",
+			expectedNetwork: "tcp",
+		},
+		{
+			buffer:          []byte("PROXY TCP6 2001:0db8:85a3:0000:0000:8a2e:0370:7334 2001:0db8:85a3:0000:0000:8a2e:0390:7334 5678 3306\r\n"),
+			expectedAddr:    "[2001:db8:85a3::8a2e:390:7334]:3306",
+			expectedNetwork: "tcp",
+		},
+		{
+			buffer:          []byte("PROXY UNKNOWN\r\n"),
+			expectedAddr:    "127.0.0.1:4000",
+			expectedNetwork: "tcp",
+		},
+		{
+			buffer:          encodeProxyProtocolV2Header("tcp4", TransportStream, "192.168.1.100:5678", "192.168.1.5:4000"),
+			expectedAddr:    "192.168.1.5:4000",
+			expectedNetwork: "tcp",
+		},
+		{
+			buffer:          encodeProxyProtocolV2Header("tcp6", TransportDgram, "[2001:db8:85a3::8a2e:370:7334]:5678", "[2001:db8:85a3::8a2e:370:8000]:4000"),
+			expectedAddr:    "[2001:db8:85a3::8a2e:370:8000]:4000",
+			expectedNetwork: "udp",
+		},
+		{
+			buffer:          encodeProxyProtocolV2Header("unix", TransportStream, "/var/run/src.sock", "/var/run/dst.sock"),
+			expectedAddr:    "/var/run/dst.sock",
+			expectedNetwork: "unix",
+		},
+		{
+			buffer:          encodeProxyProtocolV2Header("unix", TransportStream, "/var/run/src.sock", ""),
+			expectedAddr:    "127.0.0.1:4000",
+			expectedNetwork: "tcp",
+		},
+		{
+			buffer:          localCmd,
+			expectedAddr:    "127.0.0.1:4000",
+			expectedNetwork: "tcp",
+		},
+	}
+
+	l, _ := newListener(nil, "*", 5)
+	for _, test := range tests {
+		conn := newMockBufferConn(bytes.NewBuffer(test.buffer), craddr)
+		wconn, err := l.createProxyProtocolConn(conn)
+		if err != nil {
+			t.Errorf("Buffer:%v\nExpect: %s Got Error: %v", test.buffer, test.expectedAddr, err)
+			continue
+		}
+		assertEquals(t, wconn.LocalAddr().String(), test.expectedAddr)
+		assertEquals(t, wconn.LocalAddr().Network(), test.expectedNetwork)
+	}
+}
+
+func TestProxyProtocolHeaderReadInChunks(t *testing.T) {
+	craddr, _ := net.ResolveTCPAddr("tcp4", "192.168.1.51:8080")
+	tests := []struct {
+		buffer     []byte
+		expectedIP string
+	}{
+		{
+			buffer:     []byte("PROXY TCP4 192.168.1.100 192.168.1.50 5678 3306\r\nOther Data"),
+			expectedIP: "192.168.1.100:5678",
+		},
+		{
+			buffer:     append(encodeProxyProtocolV2Header("tcp4", TransportStream, "192.168.1.100:5678", "192.168.1.5:4000"), []byte("Other Data")...),
+			expectedIP: "192.168.1.100:5678",
+		},
+	}
+
+	l, _ := newListener(nil, "*", 5)
+	for _, chunkSize := range []int{1, 3, 7, 16} {
+		for _, test := range tests {
+			conn := &mockChunkConn{newMockBufferConnBytes(test.buffer, craddr), chunkSize}
+			wconn, err := l.createProxyProtocolConn(conn)
+			if err != nil {
+				t.Errorf("Buffer:%v\nChunk size: %d Expect: %s Got Error: %v", test.buffer, chunkSize, test.expectedIP, err)
+				continue
+			}
+			assertEquals(t, wconn.RemoteAddr().String(), test.expectedIP)
+			data, err := io.ReadAll(wconn)
+			assertNil(t, err)
+			assertEquals(t, string(data), "Other Data")
+		}
+	}
+}
+
+func TestProxyProtocolConnFallbackInChunks(t *testing.T) {
+	craddr, _ := net.ResolveTCPAddr("tcp4", "192.168.1.51:8080")
+	tests := []string{
+		"POST / HTTP/1.0\r\n\r\n",
+		"PROXX TCP4 192.168.1.100 192.168.1.50 5678 3306\r\n",
+		"\r\n\r\n\x00\r\nQUIX\n",
+		"\r\n\r\nOther Data",
+	}
+
+	l, _ := newListener(nil, "*", 5)
+	l.fallbackable = true
+	for _, chunkSize := range []int{1, 3, 7} {
+		for _, test := range tests {
+			conn := &mockChunkConn{newMockBufferConnBytes([]byte(test), craddr), chunkSize}
+			wconn, err := l.createProxyProtocolConn(conn)
+			if err != nil {
+				t.Errorf("Buffer:%q\nChunk size: %d Expect fallback Got Error: %v", test, chunkSize, err)
+				continue
+			}
+			assertEquals(t, wconn.RemoteAddr().String(), craddr.String())
+			data, err := io.ReadAll(wconn)
+			assertNil(t, err)
+			assertEquals(t, string(data), test)
+		}
+	}
+
+	// Client stop sending before signature complete and wait for server
+	for _, chunkSize := range []int{1, 3, 7} {
+		for _, test := range []string{"\r\n", "PRO", "PROXY", "\r\n\r\n\x00\r\nQUI"} {
+			conn := &mockTimeoutConn{&mockChunkConn{newMockBufferConnBytes([]byte(test), craddr), chunkSize}}
+			wconn, err := l.createProxyProtocolConn(conn)
+			if err != nil {
+				t.Errorf("Buffer:%q\nChunk size: %d Expect fallback Got Error: %v", test, chunkSize, err)
+				continue
+			}
+			assertEquals(t, wconn.RemoteAddr().String(), craddr.String())
+			buf := make([]byte, 1024)
+			n, err := wconn.Read(buf)
+			assertNil(t, err)
+			assertEquals(t, string(buf[0:n]), test)
+		}
+	}
+}
+
+func TestProxyProtocolHeaderTooLong(t *testing.T) {
+	craddr, _ := net.ResolveTCPAddr("tcp4", "192.168.1.51:8080")
+	l, _ := newListener(nil, "*", 5)
+
+	// v1 header without CRLF
+	buffer := []byte("PROXY TCP4 192.168.1.100 192.168.1.50 5678 3306 " + strings.Repeat("a", 1024))
+	conn := newMockBufferConn(bytes.NewBuffer(buffer), craddr)
+	_, err := l.createProxyProtocolConn(conn)
+	assertTrue(t, err == ErrHeaderTooLong)
+
+	// v2 header length larger than default limit
+	buffer = encodeProxyProtocolV2Header("tcp4", TransportStream, "192.168.1.100:5678", "192.168.1.5:4000")
+	buffer = appendProxyProtocolV2TLV(buffer, PP2TypeNoop, make([]byte, defaultMaxHeaderBytes))
+	conn = newMockBufferConn(bytes.NewBuffer(buffer), craddr)
+	_, err = l.createProxyProtocolConn(conn)
+	assertTrue(t, err == ErrHeaderTooLong)
+
+	// v2 header length larger than configured limit
+	l, _ = newListenerWithConfig(nil, Config{AllowedCIDRs: "*", MaxHeaderBytes: 64})
+	buffer = encodeProxyProtocolV2Header("tcp4", TransportStream, "192.168.1.100:5678", "192.168.1.5:4000")
+	buffer = appendProxyProtocolV2TLV(buffer, PP2TypeAuthority, []byte(strings.Repeat("a", 64)))
+	conn = newMockBufferConn(bytes.NewBuffer(buffer), craddr)
+	_, err = l.createProxyProtocolConn(conn)
+	assertTrue(t, err == ErrHeaderTooLong)
+
+	// v1 header longer than configured limit
+	buffer = []byte("PROXY TCP4 192.168.1.100 192.168.1.50 5678 3306\r\n")
+	conn = newMockBufferConn(bytes.NewBuffer(buffer), craddr)
+	_, err = l.createProxyProtocolConn(conn)
+	assertNil(t, err)
+	l, _ = newListenerWithConfig(nil, Config{AllowedCIDRs: "*", MaxHeaderBytes: 32})
+	conn = newMockBufferConn(bytes.NewBuffer(buffer), craddr)
+	_, err = l.createProxyProtocolConn(conn)
+	assertTrue(t, err == ErrHeaderTooLong)
+}
+
+func TestProxyProtocolHeader(t *testing.T) {
+	craddr, _ := net.ResolveTCPAddr("tcp4", "192.168.1.51:8080")
+	localCmd := encodeProxyProtocolV2Header("tcp4", TransportStream, "192.168.1.100:5678", "192.168.1.5:4000")
+	localCmd[v2CmdPos] = v2Version | CommandLocal
+	tests := []struct {
+		buffer            []byte
+		expectedVersion   int
+		expectedCommand   byte
+		expectedFamily    byte
+		expectedTransport byte
+		expectedSrc       string
+		expectedDst       string
+	}{
+		{[]byte("PROXY TCP4 192.168.1.100 192.168.1.50 5678 3306\r\n"), 1, CommandProxy, AFInet, TransportStream, "192.168.1.100:5678", "192.168.1.50:3306"},
+		{[]byte("PROXY TCP6 2001:db8::1 2001:db8::2 5678 3306\r\n"), 1, CommandProxy, AFInet6, TransportStream, "[2001:db8::1]:5678", "[2001:db8::2]:3306"},
+		{[]byte("PROXY UNKNOWN\r\n"), 1, CommandProxy, AFUnspec, TransportUnspec, "", ""},
+		{encodeProxyProtocolV2Header("tcp4", TransportStream, "192.168.1.100:5678", "192.168.1.5:4000"), 2, CommandProxy, AFInet, TransportStream, "192.168.1.100:5678", "192.168.1.5:4000"},
+		{encodeProxyProtocolV2Header("tcp6", TransportDgram, "[2001:db8::1]:5678", "[2001:db8::2]:4000"), 2, CommandProxy, AFInet6, TransportDgram, "[2001:db8::1]:5678", "[2001:db8::2]:4000"},
+		{encodeProxyProtocolV2Header("unix", TransportStream, "", "/var/run/dst.sock"), 2, CommandProxy, AFUnix, TransportStream, "", "/var/run/dst.sock"},
+		{localCmd, 2, CommandLocal, AFUnspec, TransportUnspec, "", ""},
+	}
+
+	addrString := func(addr net.Addr) string {
+		if addr == nil {
+			return ""
+		}
+		return addr.String()
+	}
+	l, _ := newListener(nil, "*", 5)
+	for _, test := range tests {
+		conn := newMockBufferConn(bytes.NewBuffer(test.buffer), craddr)
+		wconn, err := l.createProxyProtocolConn(conn)
+		if err != nil {
+			t.Errorf("Buffer:%v\nGot Error: %v", test.buffer, err)
+			continue
+		}
+		header := wconn.Header()
+		assertEquals(t, header.Version, test.expectedVersion)
+		assertEquals(t, header.Command, test.expectedCommand)
+		assertEquals(t, header.Family, test.expectedFamily)
+		assertEquals(t, header.Transport, test.expectedTransport)
+		assertEquals(t, addrString(header.SourceAddr), test.expectedSrc)
+		assertEquals(t, addrString(header.DestinationAddr), test.expectedDst)
+	}
+
+	// No header for fallback connection
+	l.fallbackable = true
+	conn := newMockBufferConn(bytes.NewBuffer([]byte("GET / HTTP/1.1\r\n\r\n")), craddr)
+	wconn, err := l.createProxyProtocolConn(conn)
+	assertNil(t, err)
+	assertNil(t, wconn.Header())
+}
+
 func TestProxyProtocolListenerReadHeaderTimeout(t *testing.T) {
 	addr := "127.0.0.1:18080"
 	var wg sync.WaitGroup
@@ -338,6 +971,136 @@ func TestProxyProtocolListenerReadHeaderTimeout(t *testing.T) {
 	conn.Close()
 }
 
+func TestProxyProtocolListenerReadHeaderTimeoutDuration(t *testing.T) {
+	addr := "127.0.0.1:18084"
+	l, err := net.Listen("tcp", addr)
+	assertNil(t, err)
+	ppl, err := NewListenerWithConfig(l, Config{
+		AllowedCIDRs:  "*",
+		HeaderTimeout: 200 * time.Millisecond,
+	})
+	assertNil(t, err)
+	defer ppl.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	assertNil(t, err)
+	defer conn.Close()
+	start := time.Now()
+	wconn, err := ppl.Accept()
+	assertNil(t, wconn)
+	assertTrue(t, err == ErrHeaderReadTimeout)
+	assertTrue(t, time.Since(start) < time.Second)
+}
+
+func TestProxyProtocolListenerAcceptContextCancel(t *testing.T) {
+	addr := "127.0.0.1:18085"
+	l, err := net.Listen("tcp", addr)
+	assertNil(t, err)
+	ppl, err := NewListenerWithConfig(l, Config{
+		AllowedCIDRs:  "*",
+		HeaderTimeout: 10 * time.Second,
+	})
+	assertNil(t, err)
+	defer ppl.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	assertNil(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	wconn, err := ppl.AcceptContext(ctx)
+	assertNil(t, wconn)
+	assertTrue(t, err == context.DeadlineExceeded)
+	assertTrue(t, time.Since(start) < time.Second)
+
+	// Pending connection should be closed by server
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assertTrue(t, err == io.EOF)
+}
+
+func TestProxyProtocolListenerAcceptContextOverlap(t *testing.T) {
+	addr := "127.0.0.1:18090"
+	l, err := net.Listen("tcp", addr)
+	assertNil(t, err)
+	ppl, err := NewListenerWithConfig(l, Config{
+		AllowedCIDRs:  "*",
+		HeaderTimeout: 5 * time.Second,
+	})
+	assertNil(t, err)
+	defer ppl.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		wconn, err := ppl.AcceptContext(ctx)
+		assertNil(t, err)
+		accepted <- wconn
+	}()
+
+	conn, err := net.Dial("tcp", addr)
+	assertNil(t, err)
+	defer conn.Close()
+	// Cancel one Accept should not interrupt header read for other Accept
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	wconn, err := ppl.AcceptContext(ctx)
+	assertNil(t, wconn)
+	assertTrue(t, err == context.DeadlineExceeded)
+
+	time.Sleep(200 * time.Millisecond)
+	_, err = conn.Write([]byte("PROXY TCP4 192.168.1.100 192.168.1.50 5678 3306\r\n"))
+	assertNil(t, err)
+	wconn = <-accepted
+	if wconn == nil {
+		t.Fatal("Expect connection accepted by other Accept")
+	}
+	defer wconn.Close()
+	assertEquals(t, wconn.RemoteAddr().String(), "192.168.1.100:5678")
+}
+
+func TestProxyProtocolListenerConnHeader(t *testing.T) {
+	addr := "127.0.0.1:18091"
+	l, err := net.Listen("tcp", addr)
+	assertNil(t, err)
+	ppl, err := NewListener(l, "*", 1)
+	assertNil(t, err)
+	defer ppl.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	assertNil(t, err)
+	defer conn.Close()
+	src, _ := net.ResolveTCPAddr("tcp4", "192.168.1.100:5678")
+	dst, _ := net.ResolveTCPAddr("tcp4", "192.168.1.5:4000")
+	_, err = WriteHeaderV2(conn, src, dst, map[byte][]byte{
+		PP2TypeAuthority: []byte("example.com"),
+		PP2TypeALPN:      []byte("h2"),
+	})
+	assertNil(t, err)
+
+	wconn, err := ppl.Accept()
+	assertNil(t, err)
+	defer wconn.Close()
+	ppconn, ok := wconn.(Conn)
+	assertTrue(t, ok)
+	if !ok {
+		return
+	}
+	header := ppconn.Header()
+	assertEquals(t, header.Version, 2)
+	assertEquals(t, header.Command, CommandProxy)
+	assertEquals(t, header.Family, AFInet)
+	assertEquals(t, header.Transport, TransportStream)
+	assertEquals(t, header.SourceAddr.String(), src.String())
+	assertEquals(t, header.DestinationAddr.String(), dst.String())
+	assertEquals(t, ppconn.Authority(), "example.com")
+	assertEquals(t, string(ppconn.ALPN()), "h2")
+	assertEquals(t, len(ppconn.TLVs()), 2)
+	assertNil(t, ppconn.SSL())
+}
+
 func TestProxyProtocolListenerProxyNotAllowed(t *testing.T) {
 	addr := "127.0.0.1:18081"
 	var wg sync.WaitGroup
@@ -362,6 +1125,200 @@ func TestProxyProtocolListenerProxyNotAllowed(t *testing.T) {
 	conn.Close()
 }
 
+func TestProxyProtocolListenerFallback(t *testing.T) {
+	addr := "127.0.0.1:18083"
+	l, err := net.Listen("tcp", addr)
+	assertNil(t, err)
+	ppl, err := NewListenerWithFallback(l, "*", 1, true)
+	assertNil(t, err)
+	defer ppl.Close()
+	go func() {
+		// Client send nothing
+		conn, err := net.Dial("tcp", addr)
+		assertNil(t, err)
+		defer conn.Close()
+		buf := make([]byte, 5)
+		n, err := conn.Read(buf)
+		assertNil(t, err)
+		assertEquals(t, string(buf[0:n]), "hello")
+	}()
+
+	conn, err := ppl.Accept()
+	assertNil(t, err)
+	defer conn.Close()
+	assertEquals(t, conn.RemoteAddr().String(), conn.(*proxyProtocolConn).Conn.RemoteAddr().String())
+	_, err = conn.Write([]byte("hello"))
+	assertNil(t, err)
+}
+
+func TestProxyProtocolListenerReadNotBlockAfterHeader(t *testing.T) {
+	addr := "127.0.0.1:18087"
+	l, err := net.Listen("tcp", addr)
+	assertNil(t, err)
+	ppl, err := NewListenerWithFallback(l, "*", 1, true)
+	assertNil(t, err)
+	defer ppl.Close()
+
+	tests := []struct {
+		buffer   string
+		expected string
+	}{
+		{"GET / HTTP/1.0\r\n\r\n", "GET / HTTP/1.0\r\n\r\n"},
+		{"PROXY TCP4 192.168.1.100 192.168.1.50 5678 3306\r\nhello", "hello"},
+	}
+	for _, test := range tests {
+		// Client keep connection open and wait for response
+		conn, err := net.Dial("tcp", addr)
+		assertNil(t, err)
+		_, err = conn.Write([]byte(test.buffer))
+		assertNil(t, err)
+
+		wconn, err := ppl.Accept()
+		assertNil(t, err)
+		wconn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		start := time.Now()
+		buf := make([]byte, 4096)
+		n, err := wconn.Read(buf)
+		assertNil(t, err)
+		assertEquals(t, string(buf[0:n]), test.expected)
+		assertTrue(t, time.Since(start) < time.Second)
+		wconn.Close()
+		conn.Close()
+	}
+}
+
+func TestProxyProtocolListenerOnReject(t *testing.T) {
+	craddr, _ := net.ResolveTCPAddr("tcp4", "192.168.1.51:8080")
+	var (
+		rejectedAddr   net.Addr
+		rejectedReason error
+	)
+	onReject := func(conn net.Conn, reason error) {
+		rejectedAddr = conn.RemoteAddr()
+		rejectedReason = reason
+	}
+	l, _ := newListenerWithConfig(nil, Config{AllowedCIDRs: "*", OnReject: onReject})
+	invalidV2 := encodeProxyProtocolV2Header("tcp4", TransportStream, "192.168.1.100:5678", "192.168.1.5:4000")
+	invalidV2[v2CmdPos] = 0x22
+	tests := []struct {
+		buffer         []byte
+		expectedReason error
+	}{
+		{[]byte("this is a invalid header"), ErrProxyProtocolV1HeaderInvalid},
+		{[]byte("PROXY TCP4 192.168.1.100 192.168.1.50 5678 3306 " + strings.Repeat("a", 1024)), ErrHeaderTooLong},
+		{invalidV2, ErrProxyProtocolV2HeaderInvalid},
+		// Connection closed before header complete
+		{[]byte{}, ErrProxyProtocolV1HeaderInvalid},
+		{[]byte("PROXY TCP4 192.168.1.100"), ErrProxyProtocolV1HeaderInvalid},
+		{invalidV2[0:8], ErrProxyProtocolV2HeaderInvalid},
+	}
+	for _, test := range tests {
+		rejectedAddr, rejectedReason = nil, nil
+		conn := newMockBufferConn(bytes.NewBuffer(test.buffer), craddr)
+		_, err := l.createProxyProtocolConn(conn)
+		assertTrue(t, err == test.expectedReason)
+		assertTrue(t, rejectedReason == test.expectedReason)
+		assertEquals(t, rejectedAddr.String(), craddr.String())
+	}
+
+	// Valid header should not be rejected
+	rejectedAddr, rejectedReason = nil, nil
+	conn := newMockBufferConn(bytes.NewBuffer([]byte("PROXY TCP4 192.168.1.100 192.168.1.50 5678 3306\r\n")), craddr)
+	_, err := l.createProxyProtocolConn(conn)
+	assertNil(t, err)
+	assertNil(t, rejectedAddr)
+	assertNil(t, rejectedReason)
+}
+
+func TestProxyProtocolListenerOnRejectTimeout(t *testing.T) {
+	addr := "127.0.0.1:18088"
+	l, err := net.Listen("tcp", addr)
+	assertNil(t, err)
+	rejected := make(chan error, 1)
+	ppl, err := NewListenerWithConfig(l, Config{
+		AllowedCIDRs:  "*",
+		HeaderTimeout: 200 * time.Millisecond,
+		OnReject: func(conn net.Conn, reason error) {
+			rejected <- reason
+		},
+	})
+	assertNil(t, err)
+	defer ppl.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	assertNil(t, err)
+	defer conn.Close()
+	wconn, err := ppl.Accept()
+	assertNil(t, wconn)
+	assertTrue(t, err == ErrHeaderReadTimeout)
+	assertTrue(t, <-rejected == ErrHeaderReadTimeout)
+}
+
+func TestProxyProtocolListenerOnRejectNotAllowed(t *testing.T) {
+	addr := "127.0.0.1:18086"
+	l, err := net.Listen("tcp", addr)
+	assertNil(t, err)
+	rejected := make(chan error, 1)
+	ppl, err := NewListenerWithConfig(l, Config{
+		AllowedCIDRs:  "192.168.1.1",
+		HeaderTimeout: time.Second,
+		OnReject: func(conn net.Conn, reason error) {
+			rejected <- reason
+		},
+	})
+	assertNil(t, err)
+	defer ppl.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	assertNil(t, err)
+	defer conn.Close()
+	wconn, err := ppl.Accept()
+	assertNil(t, err)
+	defer wconn.Close()
+	assertTrue(t, <-rejected == ErrProxyNotAllowed)
+}
+
+func TestProxyProtocolListenerOnRejectNotBlockAccept(t *testing.T) {
+	addr := "127.0.0.1:18089"
+	l, err := net.Listen("tcp", addr)
+	assertNil(t, err)
+	var count int32
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	ppl, err := NewListenerWithConfig(l, Config{
+		AllowedCIDRs:  "192.168.1.1",
+		HeaderTimeout: time.Second,
+		OnReject: func(conn net.Conn, reason error) {
+			// Only block for first connection
+			if atomic.AddInt32(&count, 1) == 1 {
+				close(entered)
+				<-release
+			}
+		},
+	})
+	assertNil(t, err)
+	defer ppl.Close()
+	defer close(release)
+
+	conn1, err := net.Dial("tcp", addr)
+	assertNil(t, err)
+	defer conn1.Close()
+	<-entered
+	conn2, err := net.Dial("tcp", addr)
+	assertNil(t, err)
+	defer conn2.Close()
+
+	// Second connection should be accepted while first hook is blocking
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	wconn, err := ppl.AcceptContext(ctx)
+	assertNil(t, err)
+	if wconn != nil {
+		defer wconn.Close()
+		assertEquals(t, wconn.RemoteAddr().String(), conn2.LocalAddr().String())
+	}
+}
+
 func TestProxyProtocolListenerCloseInOtherGoroutine(t *testing.T) {
 	addr := "127.0.0.1:18082"
 	l, err := net.Listen("tcp", addr)